@@ -0,0 +1,320 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+	astrasdk "github.com/datastax/astra-client-go/v2/astra"
+	"github.com/datastax/cql-proxy/astra"
+)
+
+// LoadBundleFromBytes loads a secure connect bundle from the contents of its zip file.
+func LoadBundleFromBytes(data []byte) (*astra.Bundle, error) {
+	loaded, err := loadBundleBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return loaded.Bundle, nil
+}
+
+// LoadBundleFromReader loads a secure connect bundle by reading the contents of its zip file from r.
+func LoadBundleFromReader(r io.Reader) (*astra.Bundle, error) {
+	loaded, err := loadBundleReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return loaded.Bundle, nil
+}
+
+// LoadBundleFromEnv loads a secure connect bundle from the environment variable name, which holds the contents of
+// its zip file encoded in base64. Whitespace, such as the line breaks added by the base64 command, is ignored.
+func LoadBundleFromEnv(name string) (*astra.Bundle, error) {
+	loaded, err := loadBundleEnv(name)
+	if err != nil {
+		return nil, err
+	}
+	return loaded.Bundle, nil
+}
+
+func loadBundleBytes(data []byte) (*LoadedBundle, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error creating zip reader for secure bundle zip: %w", err)
+	}
+	return loadBundleZip(reader)
+}
+
+func loadBundleReader(r io.Reader) (*LoadedBundle, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading secure bundle zip: %w", err)
+	}
+	return loadBundleBytes(data)
+}
+
+func loadBundleEnv(name string) (*LoadedBundle, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, value)
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding secure bundle zip from environment variable %s: %w", name, err)
+	}
+	return loadBundleBytes(data)
+}
+
+// loadBundleZip loads the bundle in reader along with the CA certificates it contains, which can't be retrieved
+// from the bundle's TLS configuration. Its version is derived from every file of the zip, so that a bundle whose
+// only change is its CA gets a new version.
+func loadBundleZip(reader *zip.Reader) (*LoadedBundle, error) {
+	bundle, err := astra.LoadBundleZip(reader)
+	if err != nil {
+		return nil, err
+	}
+	loaded := NewLoadedBundle(bundle)
+	h := sha256.New()
+	for _, file := range reader.File {
+		r, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			return nil, err
+		}
+		_, _ = fmt.Fprintf(h, "%s:%d\n", file.Name, len(data))
+		_, _ = h.Write(data)
+		if file.Name == BundleFileCACert {
+			loaded.CACertificates = parseCertificatesPEM(data)
+		}
+	}
+	loaded.Version = hex.EncodeToString(h.Sum(nil))
+	return loaded, nil
+}
+
+// parseCertificatesPEM returns the certificates in data, skipping blocks that can't be parsed.
+func parseCertificatesPEM(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// BundleSource loads a secure connect bundle, for instance from a file, from the Astra DevOps API or from a secret
+// manager.
+type BundleSource interface {
+	// LoadBundle loads the current copy of the bundle.
+	LoadBundle(ctx context.Context) (*LoadedBundle, error)
+}
+
+// LoadedBundle is a secure connect bundle loaded by a BundleSource.
+type LoadedBundle struct {
+	Bundle *astra.Bundle
+	// Version identifies the contents of the bundle: loads that return the same version return the same bundle. It's
+	// derived from every file of the bundle zip when the source reads it.
+	Version string
+	// Expiry is when the bundle's client certificate expires. It's zero when unknown.
+	Expiry time.Time
+	// CACertificates are the certificates of the bundle's ca.crt file. They're only known when the source reads
+	// the bundle zip itself, since they can't be retrieved from Bundle.TLSConfig.
+	CACertificates []*x509.Certificate
+}
+
+// NewLoadedBundle returns the bundle with its version and expiry, which are derived from the bundle's endpoint and
+// client certificate. The CA certificates can't be retrieved from the bundle's TLS configuration, so they aren't
+// part of the version.
+func NewLoadedBundle(bundle *astra.Bundle) *LoadedBundle {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s:%d\n", bundle.Host, bundle.Port)
+	var expiry time.Time
+	if bundle.TLSConfig != nil {
+		for _, cert := range bundle.TLSConfig.Certificates {
+			for _, der := range cert.Certificate {
+				_, _ = h.Write(der)
+			}
+			if expiry.IsZero() && len(cert.Certificate) > 0 {
+				if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+					expiry = leaf.NotAfter
+				}
+			}
+		}
+	}
+	return &LoadedBundle{
+		Bundle:  bundle,
+		Version: hex.EncodeToString(h.Sum(nil)),
+		Expiry:  expiry,
+	}
+}
+
+// FileBundleSource loads the secure connect bundle zip file at Path.
+type FileBundleSource struct {
+	Path string
+}
+
+func (s *FileBundleSource) LoadBundle(_ context.Context) (*LoadedBundle, error) {
+	reader, err := zip.OpenReader(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	return loadBundleZip(&reader.Reader)
+}
+
+// URLBundleSource downloads the secure connect bundle of a database from the Astra DevOps API.
+//
+// When CacheDir is set, downloaded bundles are also written to that directory. A cached bundle whose certificates
+// are still valid is returned without waiting for the DevOps API, which is then queried in the background to update
+// the cache, so processes can start while the API is slow or unreachable.
+type URLBundleSource struct {
+	// URL is the Astra DevOps API URL, usually AstraAPIURL.
+	URL        string
+	DatabaseID string
+	Token      string
+	// TokenProvider provides the token when it's set, instead of Token.
+	TokenProvider TokenProvider
+	// Timeout bounds the download.
+	Timeout time.Duration
+	// CacheDir is the directory where downloaded bundles are cached. It's created with permissions restricted to
+	// the current user if it doesn't exist. Bundles aren't cached when it's empty.
+	CacheDir string
+	// Logger logs failures to update the cache in the background. It can be nil.
+	Logger gocql.StructuredLogger
+	// HTTPClient makes the requests to the DevOps API and downloads the bundle. http.DefaultClient is used when it's
+	// nil. The dialers created by NewDialerFromURL use a client that goes through the dialer's proxy and dial
+	// function.
+	HTTPClient *http.Client
+
+	refreshing atomic.Bool
+}
+
+func (s *URLBundleSource) LoadBundle(ctx context.Context) (*LoadedBundle, error) {
+	if s.CacheDir == "" {
+		data, err := s.download(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return loadBundleBytes(data)
+	}
+	return s.loadCachedBundle(ctx)
+}
+
+// download downloads the bundle zip from the DevOps API.
+func (s *URLBundleSource) download(ctx context.Context) ([]byte, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	token := s.Token
+	if s.TokenProvider != nil {
+		var err error
+		if token, err = s.TokenProvider.Token(ctx); err != nil {
+			return nil, fmt.Errorf("unable to get Astra application token: %w", err)
+		}
+	}
+
+	httpClient := s.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	client, err := astrasdk.NewClientWithResponses(s.URL, astrasdk.WithHTTPClient(httpClient), func(c *astrasdk.Client) error {
+		c.RequestEditors = append(c.RequestEditors, func(ctx context.Context, req *http.Request) error {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating secure bundle zip URLs: %w", err)
+	}
+	// All bundles are requested because the generated client can't deserialize the response for a single one
+	all := true
+	res, err := client.GenerateSecureBundleURLWithResponse(ctx, s.DatabaseID, &astrasdk.GenerateSecureBundleURLParams{All: &all})
+	if err != nil {
+		return nil, fmt.Errorf("error generating secure bundle zip URLs: %w", err)
+	}
+	if res.StatusCode() != http.StatusOK || res.JSON200 == nil || len(*res.JSON200) == 0 {
+		return nil, fmt.Errorf("unable to generate secure bundle zip URLs, failed with status code %d", res.StatusCode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, (*res.JSON200)[0].DownloadURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading secure bundle zip: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading secure bundle zip: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading secure bundle zip, failed with status code %d", resp.StatusCode)
+	}
+	data, err := readAllWithTimeout(resp.Body, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading downloaded secure bundle zip: %w", err)
+	}
+	return data, nil
+}
+
+// StaticBundleSource always returns Bundle, which was loaded beforehand.
+type StaticBundleSource struct {
+	Bundle *astra.Bundle
+}
+
+func (s *StaticBundleSource) LoadBundle(_ context.Context) (*LoadedBundle, error) {
+	if s.Bundle == nil {
+		return nil, errors.New("no secure connect bundle")
+	}
+	return NewLoadedBundle(s.Bundle), nil
+}
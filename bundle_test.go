@@ -0,0 +1,200 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testSerialNumber atomic.Int64
+
+// testCA is a certificate authority issuing the certificates of the test bundles and servers.
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	cert, _ := issueTestCertificate(t, template, key, nil, key)
+	return &testCA{cert: cert, key: key}
+}
+
+// issueTestCertificate signs template, holding the public key of key, with the CA, or self-signs it when ca is nil.
+func issueTestCertificate(t *testing.T, template *x509.Certificate, key crypto.Signer, ca *x509.Certificate, caKey crypto.Signer) (*x509.Certificate, []byte) {
+	t.Helper()
+	template.SerialNumber = big.NewInt(testSerialNumber.Add(1))
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+	if ca == nil {
+		ca = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, der
+}
+
+// certificate issues a leaf certificate for hosts, which are DNS names or IP addresses.
+func (ca *testCA) certificate(t *testing.T, extKeyUsage x509.ExtKeyUsage, hosts ...string) tls.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "test"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{extKeyUsage},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return ca.issue(t, template)
+}
+
+// issue issues a certificate from template for a new ECDSA key.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	cert, der := issueTestCertificate(t, template, key, ca.cert, ca.key)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// bundleZip returns a secure connect bundle zip for the metadata service at host:port, with a client certificate
+// issued by the CA.
+func (ca *testCA) bundleZip(t *testing.T, host string, port int) []byte {
+	t.Helper()
+	return ca.bundleZipWithClient(t, host, port, ca.certificate(t, x509.ExtKeyUsageClientAuth, "client"))
+}
+
+// bundleZipWithClient returns a secure connect bundle zip for the metadata service at host:port, with the client
+// certificate client.
+func (ca *testCA) bundleZipWithClient(t *testing.T, host string, port int, client tls.Certificate) []byte {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	require.NoError(t, err)
+	config, err := json.Marshal(map[string]interface{}{"host": host, "port": port})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"config.json":    config,
+		BundleFileCACert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}),
+		"cert":           pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: client.Certificate[0]}),
+		"key":            pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+	} {
+		f, err := w.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// loadedBundle returns the bundle for the metadata service at host:port, loaded as from a zip.
+func (ca *testCA) loadedBundle(t *testing.T, host string, port int) *LoadedBundle {
+	t.Helper()
+	loaded, err := loadBundleBytes(ca.bundleZip(t, host, port))
+	require.NoError(t, err)
+	return loaded
+}
+
+func TestLoadBundleBytes(t *testing.T) {
+	ca := newTestCA(t)
+	loaded := ca.loadedBundle(t, "127.0.0.1", 29080)
+	require.Equal(t, "127.0.0.1", loaded.Bundle.Host)
+	require.Equal(t, 29080, loaded.Bundle.Port)
+	require.Len(t, loaded.CACertificates, 1)
+	require.Equal(t, ca.cert.Raw, loaded.CACertificates[0].Raw)
+	require.False(t, loaded.Expiry.IsZero())
+	require.NotEmpty(t, loaded.Version)
+}
+
+func TestLoadedBundleVersion(t *testing.T) {
+	ca := newTestCA(t)
+	data := ca.bundleZip(t, "127.0.0.1", 29080)
+	first, err := loadBundleBytes(data)
+	require.NoError(t, err)
+	second, err := loadBundleBytes(data)
+	require.NoError(t, err)
+	require.Equal(t, first.Version, second.Version)
+
+	// Only the CA changes
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, file := range reader.File {
+		r, err := file.Open()
+		require.NoError(t, err)
+		var contents bytes.Buffer
+		_, err = contents.ReadFrom(r)
+		require.NoError(t, err)
+		_ = r.Close()
+		if file.Name == BundleFileCACert {
+			other := newTestCA(t)
+			contents.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.cert.Raw}))
+		}
+		f, err := w.Create(file.Name)
+		require.NoError(t, err)
+		_, err = f.Write(contents.Bytes())
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	rotated, err := loadBundleBytes(buf.Bytes())
+	require.NoError(t, err)
+	require.Len(t, rotated.CACertificates, 2)
+	require.NotEqual(t, first.Version, rotated.Version)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+)
+
+// loadCachedBundle returns the cached bundle if it's still valid and refreshes it in the background. Otherwise, it
+// downloads the bundle and caches it.
+func (s *URLBundleSource) loadCachedBundle(ctx context.Context) (*LoadedBundle, error) {
+	path := s.cachePath()
+	cached, cacheErr := loadCachedBundleFile(path, time.Now())
+	if cacheErr == nil {
+		s.refreshCacheInBackground(path)
+		return cached, nil
+	}
+
+	data, err := s.download(ctx)
+	if err != nil {
+		if os.IsNotExist(cacheErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w (cached bundle %s is unusable: %v)", err, path, cacheErr)
+	}
+	loaded, err := loadBundleBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(path, data); err != nil {
+		s.logger().Warning("Unable to cache secure connect bundle.",
+			gocql.NewLogFieldString("path", path),
+			gocql.NewLogFieldError("error", err))
+	}
+	return loaded, nil
+}
+
+// refreshCacheInBackground downloads the bundle and updates the cache, unless a refresh is already running.
+func (s *URLBundleSource) refreshCacheInBackground(path string) {
+	if !s.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.refreshing.Store(false)
+		data, err := s.download(context.Background())
+		if err == nil {
+			_, err = loadBundleBytes(data)
+		}
+		if err == nil {
+			err = writeFileAtomic(path, data)
+		}
+		if err != nil {
+			s.logger().Warning("Unable to refresh cached secure connect bundle, keeping the cached one.",
+				gocql.NewLogFieldString("path", path),
+				gocql.NewLogFieldError("error", err))
+			return
+		}
+		s.logger().Debug("Refreshed cached secure connect bundle.", gocql.NewLogFieldString("path", path))
+	}()
+}
+
+// cachePath returns the path of the cached bundle, which is derived from the DevOps API URL and the database ID so
+// that sources for different databases can share the cache directory.
+func (s *URLBundleSource) cachePath() string {
+	sum := sha256.Sum256([]byte(s.URL + "\n" + s.DatabaseID))
+	return filepath.Join(s.CacheDir, "secure-connect-"+hex.EncodeToString(sum[:8])+".zip")
+}
+
+func (s *URLBundleSource) logger() gocql.StructuredLogger {
+	if s.Logger == nil {
+		return emptyLoggerSingleton
+	}
+	return s.Logger
+}
+
+// loadCachedBundleFile loads the bundle cached at path and checks that its certificates are valid at now.
+func loadCachedBundleFile(path string, now time.Time) (*LoadedBundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := loadBundleBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCertificatesValid(bundleCertificates(loaded), now); err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
+
+// writeFileAtomic writes data to path with permissions restricted to the current user, creating its directory if
+// needed. The file is replaced atomically so readers never see a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	// os.CreateTemp creates the file with 0600 permissions
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
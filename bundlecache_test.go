@@ -0,0 +1,167 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// devOpsAPI is a fake Astra DevOps API serving the secure connect bundle of database "db".
+type devOpsAPI struct {
+	server    *httptest.Server
+	bundle    []byte
+	downloads atomic.Int32
+}
+
+func startDevOpsAPI(t *testing.T, bundle []byte) *devOpsAPI {
+	t.Helper()
+	api := &devOpsAPI{bundle: bundle}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/databases/db/secureBundleURL", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `[{"downloadURL":%q}]`, api.server.URL+"/bundle.zip")
+	})
+	mux.HandleFunc("/bundle.zip", func(w http.ResponseWriter, _ *http.Request) {
+		api.downloads.Add(1)
+		_, _ = w.Write(api.bundle)
+	})
+	api.server = httptest.NewServer(mux)
+	t.Cleanup(api.server.Close)
+	return api
+}
+
+func newCachingSource(t *testing.T, url string) *URLBundleSource {
+	t.Helper()
+	s := &URLBundleSource{
+		URL:        url,
+		DatabaseID: "db",
+		Token:      "token",
+		Timeout:    time.Second,
+		CacheDir:   filepath.Join(t.TempDir(), "cache"),
+	}
+	t.Cleanup(func() {
+		// Wait for the background refresh, which may still write to the cache directory
+		require.Eventually(t, func() bool { return !s.refreshing.Load() }, time.Second, time.Millisecond)
+	})
+	return s
+}
+
+func TestNewDialerFromURLUsesDialContext(t *testing.T) {
+	ca := newTestCA(t)
+	api := startDevOpsAPI(t, ca.bundleZip(t, "127.0.0.1", 29080))
+	var dials atomic.Int32
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	d, err := NewDialerFromURL(api.server.URL, "db", "token", time.Second, WithDialContext(dial))
+	require.NoError(t, err)
+	defer d.Close()
+	require.Equal(t, int32(1), api.downloads.Load())
+	require.NotZero(t, dials.Load())
+}
+
+func TestURLBundleSourceCacheHit(t *testing.T) {
+	ca := newTestCA(t)
+	api := startDevOpsAPI(t, ca.bundleZip(t, "127.0.0.1", 29080))
+	s := newCachingSource(t, api.server.URL)
+
+	downloaded, err := s.LoadBundle(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int32(1), api.downloads.Load())
+
+	// Served from the cache, then refreshed in the background
+	cached, err := s.LoadBundle(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, downloaded.Version, cached.Version)
+	require.Eventually(t, func() bool { return api.downloads.Load() == 2 }, time.Second, time.Millisecond)
+}
+
+func TestURLBundleSourceCacheWhileAPIDown(t *testing.T) {
+	ca := newTestCA(t)
+	data := ca.bundleZip(t, "127.0.0.1", 29080)
+	s := newCachingSource(t, fmt.Sprintf("http://127.0.0.1:%d", closedPort(t)))
+
+	_, err := s.LoadBundle(context.Background())
+	require.Error(t, err, "nothing cached yet")
+
+	require.NoError(t, writeFileAtomic(s.cachePath(), data))
+	loaded, err := s.LoadBundle(context.Background())
+	require.NoError(t, err)
+	expected, err := loadBundleBytes(data)
+	require.NoError(t, err)
+	require.Equal(t, expected.Version, loaded.Version)
+}
+
+func TestURLBundleSourceExpiredCache(t *testing.T) {
+	ca := newTestCA(t)
+	expired := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "expired"},
+		NotBefore:   time.Now().Add(-48 * time.Hour),
+		NotAfter:    time.Now().Add(-24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	api := startDevOpsAPI(t, ca.bundleZip(t, "127.0.0.1", 29080))
+	s := newCachingSource(t, api.server.URL)
+	require.NoError(t, writeFileAtomic(s.cachePath(), ca.bundleZipWithClient(t, "127.0.0.1", 29080, expired)))
+
+	loaded, err := s.LoadBundle(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int32(1), api.downloads.Load())
+	require.True(t, loaded.Expiry.After(time.Now()))
+	cached, err := loadCachedBundleFile(s.cachePath(), time.Now())
+	require.NoError(t, err)
+	require.Equal(t, loaded.Version, cached.Version)
+
+	// Unusable, and the API is down
+	api.server.Close()
+	require.NoError(t, writeFileAtomic(s.cachePath(), ca.bundleZipWithClient(t, "127.0.0.1", 29080, expired)))
+	_, err = s.LoadBundle(context.Background())
+	require.ErrorContains(t, err, "is unusable")
+}
+
+func TestURLBundleSourceCachePermissions(t *testing.T) {
+	ca := newTestCA(t)
+	api := startDevOpsAPI(t, ca.bundleZip(t, "127.0.0.1", 29080))
+	s := newCachingSource(t, api.server.URL)
+
+	_, err := s.LoadBundle(context.Background())
+	require.NoError(t, err)
+	info, err := os.Stat(s.CacheDir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+	info, err = os.Stat(s.cachePath())
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
@@ -0,0 +1,191 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+)
+
+// certificateExpiryCheckInterval is how often, at most, dialing checks the certificates of the bundle against the
+// expiry warning thresholds.
+const certificateExpiryCheckInterval = time.Hour
+
+// DefaultCertificateExpiryWarnings are the times before a bundle certificate expires at which a warning is logged.
+var DefaultCertificateExpiryWarnings = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+// Files of a secure connect bundle that hold certificates.
+const (
+	BundleFileClientCert = "cert"
+	BundleFileCACert     = "ca.crt"
+)
+
+// BundleCertificate describes a certificate of the secure connect bundle.
+type BundleCertificate struct {
+	// File is the bundle file holding the certificate, either BundleFileClientCert or BundleFileCACert.
+	File         string
+	Subject      string
+	Issuer       string
+	SerialNumber string
+	IsCA         bool
+	NotBefore    time.Time
+	NotAfter     time.Time
+}
+
+// ExpiredCertificateError is returned when creating a dialer configured with WithRejectExpiredBundle from a bundle
+// whose certificates have expired or aren't valid yet.
+type ExpiredCertificateError struct {
+	Certificate BundleCertificate
+}
+
+func (e *ExpiredCertificateError) Error() string {
+	if time.Now().Before(e.Certificate.NotBefore) {
+		return fmt.Sprintf("bundle certificate %q (%s) isn't valid before %s", e.Certificate.Subject,
+			e.Certificate.File, e.Certificate.NotBefore.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("bundle certificate %q (%s) expired on %s", e.Certificate.Subject,
+		e.Certificate.File, e.Certificate.NotAfter.Format(time.RFC3339))
+}
+
+// bundleCertificates returns the client certificate chain of the bundle followed by its CA certificates, when known.
+func bundleCertificates(loaded *LoadedBundle) []BundleCertificate {
+	var certs []BundleCertificate
+	if loaded.Bundle != nil && loaded.Bundle.TLSConfig != nil {
+		for _, cert := range loaded.Bundle.TLSConfig.Certificates {
+			for _, der := range cert.Certificate {
+				if parsed, err := x509.ParseCertificate(der); err == nil {
+					certs = append(certs, newBundleCertificate(BundleFileClientCert, parsed))
+				}
+			}
+		}
+	}
+	for _, cert := range loaded.CACertificates {
+		certs = append(certs, newBundleCertificate(BundleFileCACert, cert))
+	}
+	return certs
+}
+
+func newBundleCertificate(file string, cert *x509.Certificate) BundleCertificate {
+	return BundleCertificate{
+		File:         file,
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		IsCA:         cert.IsCA,
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+}
+
+// checkCertificatesValid returns an ExpiredCertificateError for the first certificate that isn't valid at now.
+func checkCertificatesValid(certs []BundleCertificate, now time.Time) error {
+	for _, cert := range certs {
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return &ExpiredCertificateError{Certificate: cert}
+		}
+	}
+	return nil
+}
+
+// certificateExpiryMonitor logs a warning when a bundle certificate gets within one of the thresholds of its expiry.
+// Each threshold is only logged once per certificate.
+type certificateExpiryMonitor struct {
+	thresholds []time.Duration // Sorted from the largest to the smallest
+	mu         sync.Mutex
+	warned     map[string]int // Index of the smallest threshold already logged for a certificate
+	lastCheck  time.Time
+}
+
+func newCertificateExpiryMonitor(thresholds []time.Duration) *certificateExpiryMonitor {
+	sorted := append([]time.Duration(nil), thresholds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+	return &certificateExpiryMonitor{
+		thresholds: sorted,
+		warned:     make(map[string]int),
+	}
+}
+
+func (m *certificateExpiryMonitor) check(certs []BundleCertificate, now time.Time, logger gocql.StructuredLogger) {
+	if len(m.thresholds) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastCheck = now
+	for _, cert := range certs {
+		key := cert.Issuer + "/" + cert.SerialNumber
+		remaining := cert.NotAfter.Sub(now)
+		crossed := -1
+		for i, threshold := range m.thresholds {
+			if remaining <= threshold {
+				crossed = i
+			}
+		}
+		if remaining <= 0 {
+			crossed = len(m.thresholds)
+		}
+		if prev, ok := m.warned[key]; crossed < 0 || (ok && prev >= crossed) {
+			continue
+		}
+		m.warned[key] = crossed
+		fields := []gocql.LogField{
+			gocql.NewLogFieldString("file", cert.File),
+			gocql.NewLogFieldString("subject", cert.Subject),
+			gocql.NewLogFieldString("not_after", cert.NotAfter.Format(time.RFC3339)),
+		}
+		if remaining <= 0 {
+			logger.Error("Secure connect bundle certificate has expired.", fields...)
+		} else {
+			logger.Warning("Secure connect bundle certificate expires soon.",
+				append(fields, gocql.NewLogFieldString("remaining", remaining.Round(time.Minute).String()))...)
+		}
+	}
+}
+
+// due reports whether the certificates weren't checked for certificateExpiryCheckInterval, and claims the check when
+// they weren't so that concurrent dials don't all make it.
+func (m *certificateExpiryMonitor) due(now time.Time) bool {
+	if len(m.thresholds) == 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastCheck) < certificateExpiryCheckInterval {
+		return false
+	}
+	m.lastCheck = now
+	return true
+}
+
+// checkCertificateExpiryIfDue checks the certificates of the bundle in use when they weren't checked recently. It's
+// called when dialing, so a dialer that isn't used anymore doesn't keep checking.
+func (d *dialer) checkCertificateExpiryIfDue() {
+	if d.certExpiryMonitor.due(time.Now()) {
+		d.checkCertificateExpiry()
+	}
+}
+
+func (d *dialer) checkCertificateExpiry() {
+	d.certExpiryMonitor.check(d.Certificates(), time.Now(), d.logger)
+}
+
+func (d *dialer) Certificates() []BundleCertificate {
+	return bundleCertificates(d.bundle.Load())
+}
@@ -0,0 +1,47 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateExpiryMonitorDue(t *testing.T) {
+	m := newCertificateExpiryMonitor(DefaultCertificateExpiryWarnings)
+	now := time.Now()
+	m.check(nil, now, emptyLoggerSingleton)
+	require.False(t, m.due(now.Add(time.Minute)))
+	require.True(t, m.due(now.Add(certificateExpiryCheckInterval)))
+	// Claimed by the previous call
+	require.False(t, m.due(now.Add(certificateExpiryCheckInterval)))
+
+	require.False(t, newCertificateExpiryMonitor(nil).due(now))
+}
+
+func TestCertificateExpiryMonitorCheck(t *testing.T) {
+	m := newCertificateExpiryMonitor([]time.Duration{24 * time.Hour, 7 * 24 * time.Hour})
+	now := time.Now()
+	cert := BundleCertificate{File: BundleFileClientCert, Issuer: "ca", SerialNumber: "1", NotAfter: now.Add(3 * 24 * time.Hour)}
+
+	m.check([]BundleCertificate{cert}, now, emptyLoggerSingleton)
+	require.Equal(t, 0, m.warned["ca/1"])
+	m.check([]BundleCertificate{cert}, now.Add(2*24*time.Hour+time.Hour), emptyLoggerSingleton)
+	require.Equal(t, 1, m.warned["ca/1"])
+	m.check([]BundleCertificate{cert}, now.Add(4*24*time.Hour), emptyLoggerSingleton)
+	require.Equal(t, 2, m.warned["ca/1"])
+}
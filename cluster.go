@@ -15,37 +15,124 @@
 package gocqlastra
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"time"
 
 	gocql "github.com/apache/cassandra-gocql-driver/v2"
+	"github.com/datastax/cql-proxy/astra"
 )
 
-func NewClusterFromBundle(path, username, password string, timeout time.Duration) (*gocql.ClusterConfig, error) {
-	return NewClusterFromBundleWithLogger(path, username, password, timeout, nil)
+// ClusterOption configures optional behavior of a cluster created by NewClusterWithOptions or one of the
+// NewClusterFrom* functions.
+type ClusterOption func(*clusterOptions)
+
+type clusterOptions struct {
+	localDCAwareRouting bool
+	dialerOptions       []DialerOption
+}
+
+// WithLocalDCAwareRouting makes the cluster route queries to the local datacenter reported by the Astra metadata
+// service, using a token-aware, DC-aware host selection policy, and sets LOCAL_QUORUM as the default consistency.
+// The metadata is resolved when the cluster is created.
+func WithLocalDCAwareRouting() ClusterOption {
+	return func(o *clusterOptions) {
+		o.localDCAwareRouting = true
+	}
+}
+
+// WithDialerOptions sets the options of the dialer created by the NewClusterFrom* functions. It has no effect on
+// NewClusterWithOptions, which is given an existing dialer.
+func WithDialerOptions(opts ...DialerOption) ClusterOption {
+	return func(o *clusterOptions) {
+		o.dialerOptions = append(o.dialerOptions, opts...)
+	}
+}
+
+func NewClusterFromBundle(path, username, password string, timeout time.Duration, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	return NewClusterFromBundleWithLogger(path, username, password, timeout, nil, opts...)
+}
+
+func NewClusterFromURL(url, databaseID, token string, timeout time.Duration, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	return NewClusterFromURLWithLogger(url, databaseID, token, timeout, nil, opts...)
+}
+
+func NewClusterFromSource(source BundleSource, username, password string, timeout time.Duration, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	return NewClusterFromSourceWithLogger(source, username, password, timeout, nil, opts...)
 }
 
-func NewClusterFromURL(url, databaseID, token string, timeout time.Duration) (*gocql.ClusterConfig, error) {
-	return NewClusterFromURLWithLogger(url, databaseID, token, timeout, nil)
+func NewClusterFromBundleBytes(data []byte, username, password string, timeout time.Duration, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	return NewClusterFromBundleBytesWithLogger(data, username, password, timeout, nil, opts...)
+}
+
+func NewClusterFromBundleReader(r io.Reader, username, password string, timeout time.Duration, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	return NewClusterFromBundleReaderWithLogger(r, username, password, timeout, nil, opts...)
+}
+
+func NewClusterFromBundleEnv(name, username, password string, timeout time.Duration, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	return NewClusterFromBundleEnvWithLogger(name, username, password, timeout, nil, opts...)
 }
 
 func NewCluster(dialer gocql.HostDialer, username, password string) *gocql.ClusterConfig {
 	return NewClusterWithLogger(dialer, username, password, nil)
 }
 
-func NewClusterFromBundleWithLogger(path, username, password string, timeout time.Duration, logger gocql.StructuredLogger) (*gocql.ClusterConfig, error) {
-	dialer, err := NewDialerFromBundleWithLogger(path, timeout, logger)
+func NewClusterFromBundleWithLogger(path, username, password string, timeout time.Duration, logger gocql.StructuredLogger, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	o := newClusterOptions(opts)
+	dialer, err := NewDialerFromBundleWithLogger(path, timeout, logger, o.dialerOptions...)
 	if err != nil {
 		return nil, err
 	}
-	return NewClusterWithLogger(dialer, username, password, logger), nil
+	return newClusterWithOptions(dialer, username, password, logger, o)
 }
 
-func NewClusterFromURLWithLogger(url, databaseID, token string, timeout time.Duration, logger gocql.StructuredLogger) (*gocql.ClusterConfig, error) {
-	dialer, err := NewDialerFromURLWithLogger(url, databaseID, token, timeout, logger)
+func NewClusterFromURLWithLogger(url, databaseID, token string, timeout time.Duration, logger gocql.StructuredLogger, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	o := newClusterOptions(opts)
+	dialer, err := NewDialerFromURLWithLogger(url, databaseID, token, timeout, logger, o.dialerOptions...)
 	if err != nil {
 		return nil, err
 	}
-	return NewClusterWithLogger(dialer, "token", token, logger), nil
+	return newClusterWithOptions(dialer, "token", token, logger, o)
+}
+
+func NewClusterFromSourceWithLogger(source BundleSource, username, password string, timeout time.Duration, logger gocql.StructuredLogger, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	o := newClusterOptions(opts)
+	dialer, err := NewDialerFromSourceWithLogger(source, timeout, logger, o.dialerOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return newClusterWithOptions(dialer, username, password, logger, o)
+}
+
+func NewClusterFromBundleBytesWithLogger(data []byte, username, password string, timeout time.Duration, logger gocql.StructuredLogger, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	bundle, err := LoadBundleFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return newClusterFromBundle(bundle, username, password, timeout, logger, newClusterOptions(opts))
+}
+
+func NewClusterFromBundleReaderWithLogger(r io.Reader, username, password string, timeout time.Duration, logger gocql.StructuredLogger, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	bundle, err := LoadBundleFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return newClusterFromBundle(bundle, username, password, timeout, logger, newClusterOptions(opts))
+}
+
+func NewClusterFromBundleEnvWithLogger(name, username, password string, timeout time.Duration, logger gocql.StructuredLogger, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	bundle, err := LoadBundleFromEnv(name)
+	if err != nil {
+		return nil, err
+	}
+	return newClusterFromBundle(bundle, username, password, timeout, logger, newClusterOptions(opts))
+}
+
+// NewClusterWithOptions is like NewClusterWithLogger but also applies cluster options. Options that need Astra
+// metadata, such as WithLocalDCAwareRouting, require dialer to be an AstraDialer.
+func NewClusterWithOptions(dialer gocql.HostDialer, username, password string, logger gocql.StructuredLogger, opts ...ClusterOption) (*gocql.ClusterConfig, error) {
+	return newClusterWithOptions(dialer, username, password, logger, newClusterOptions(opts))
 }
 
 func NewClusterWithLogger(dialer gocql.HostDialer, username, password string, logger gocql.StructuredLogger) *gocql.ClusterConfig {
@@ -64,3 +151,42 @@ func NewClusterWithLogger(dialer gocql.HostDialer, username, password string, lo
 	}
 	return cluster
 }
+
+func newClusterOptions(opts []ClusterOption) *clusterOptions {
+	o := &clusterOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func newClusterFromBundle(bundle *astra.Bundle, username, password string, timeout time.Duration, logger gocql.StructuredLogger, o *clusterOptions) (*gocql.ClusterConfig, error) {
+	dialer, err := NewDialerWithLogger(bundle, timeout, logger, o.dialerOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return newClusterWithOptions(dialer, username, password, logger, o)
+}
+
+func newClusterWithOptions(dialer gocql.HostDialer, username, password string, logger gocql.StructuredLogger, o *clusterOptions) (*gocql.ClusterConfig, error) {
+	cluster := NewClusterWithLogger(dialer, username, password, logger)
+	if provider := peekDialerOptions(o.dialerOptions).tokenProvider; provider != nil {
+		cluster.Authenticator = NewTokenAuthenticator(provider)
+	}
+	if o.localDCAwareRouting {
+		astraDialer, ok := dialer.(AstraDialer)
+		if !ok {
+			return nil, fmt.Errorf("local DC aware routing requires an AstraDialer, got %T", dialer)
+		}
+		metadata, err := astraDialer.Metadata(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine the local DC: %w", err)
+		}
+		if metadata.LocalDc == "" {
+			return nil, fmt.Errorf("unable to determine the local DC: Astra metadata for region %q has no local DC", metadata.Region)
+		}
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(metadata.LocalDc))
+		cluster.Consistency = gocql.LocalQuorum
+	}
+	return cluster, nil
+}
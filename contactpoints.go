@@ -0,0 +1,153 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultContactPointBaseBackoff is how long a contact point is skipped by default after its first failed dial.
+	DefaultContactPointBaseBackoff = time.Second
+	// DefaultContactPointMaxBackoff caps by default how long a contact point that keeps failing is skipped.
+	DefaultContactPointMaxBackoff = time.Minute
+)
+
+// ContactPointHealth is the dial history of one of the contact points reported by the Astra metadata service.
+type ContactPointHealth struct {
+	// HostID is the host ID of the contact point.
+	HostID string
+	// Successes and Failures count the dials to the contact point.
+	Successes uint64
+	Failures  uint64
+	// ConsecutiveFailures counts the failed dials since the last successful one.
+	ConsecutiveFailures int
+	// LastSuccess and LastFailure are when the contact point was last dialed successfully and unsuccessfully.
+	LastSuccess time.Time
+	LastFailure time.Time
+	// LastError is the error of the last failed dial.
+	LastError error
+	// SkippedUntil is when the contact point is dialed again after failing. It's zero once it's dialed successfully.
+	SkippedUntil time.Time
+}
+
+// contactPointTracker picks the contact point used to bootstrap a connection, going round-robin through the contact
+// points but skipping those that recently failed, for a time that grows with each consecutive failure.
+type contactPointTracker struct {
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	mu          sync.Mutex
+	index       int
+	health      map[string]*ContactPointHealth
+}
+
+func newContactPointTracker(baseBackoff, maxBackoff time.Duration) *contactPointTracker {
+	return &contactPointTracker{
+		baseBackoff: baseBackoff,
+		maxBackoff:  maxBackoff,
+		health:      make(map[string]*ContactPointHealth),
+	}
+}
+
+// next returns the next contact point that isn't being skipped. When all of them are, the one that's skipped for the
+// shortest time is returned.
+func (t *contactPointTracker) next(contactPoints []string) string {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.syncLocked(contactPoints)
+
+	var earliest string
+	for i := 0; i < len(contactPoints); i++ {
+		t.index++
+		hostId := contactPoints[t.index%len(contactPoints)]
+		h := t.health[hostId]
+		if !now.Before(h.SkippedUntil) {
+			return hostId
+		}
+		if earliest == "" || h.SkippedUntil.Before(t.health[earliest].SkippedUntil) {
+			earliest = hostId
+		}
+	}
+	return earliest
+}
+
+// syncLocked tracks the current contact points and forgets those that were removed from the metadata. t.mu must be
+// held.
+func (t *contactPointTracker) syncLocked(contactPoints []string) {
+	current := make(map[string]struct{}, len(contactPoints))
+	for _, hostId := range contactPoints {
+		current[hostId] = struct{}{}
+		if _, ok := t.health[hostId]; !ok {
+			t.health[hostId] = &ContactPointHealth{HostID: hostId}
+		}
+	}
+	for hostId := range t.health {
+		if _, ok := current[hostId]; !ok {
+			delete(t.health, hostId)
+		}
+	}
+}
+
+// record updates the health of a contact point after a dial. It returns how long the contact point is skipped, which
+// is zero after a successful dial.
+func (t *contactPointTracker) record(hostId string, err error) time.Duration {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.health[hostId]
+	if !ok {
+		h = &ContactPointHealth{HostID: hostId}
+		t.health[hostId] = h
+	}
+	if err == nil {
+		h.Successes++
+		h.ConsecutiveFailures = 0
+		h.LastSuccess = now
+		h.SkippedUntil = time.Time{}
+		return 0
+	}
+
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.LastFailure = now
+	h.LastError = err
+	backoff := t.baseBackoff
+	for i := 1; i < h.ConsecutiveFailures && (t.maxBackoff <= 0 || backoff < t.maxBackoff); i++ {
+		backoff *= 2
+	}
+	if t.maxBackoff > 0 && backoff > t.maxBackoff {
+		backoff = t.maxBackoff
+	}
+	h.SkippedUntil = now.Add(backoff)
+	return backoff
+}
+
+func (t *contactPointTracker) list() []ContactPointHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := make([]ContactPointHealth, 0, len(t.health))
+	for _, h := range t.health {
+		health = append(health, *h)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].HostID < health[j].HostID
+	})
+	return health
+}
@@ -0,0 +1,91 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactPointBackoff(t *testing.T) {
+	tracker := newContactPointTracker(time.Second, 5*time.Second)
+	dialErr := errors.New("dial failed")
+
+	// Doubles with each consecutive failure, up to the max
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		require.Equal(t, expected, tracker.record("a", dialErr))
+	}
+	health := tracker.list()
+	require.Len(t, health, 1)
+	require.Equal(t, uint64(5), health[0].Failures)
+	require.Equal(t, 5, health[0].ConsecutiveFailures)
+	require.Equal(t, dialErr, health[0].LastError)
+	require.False(t, health[0].SkippedUntil.IsZero())
+
+	// A success resets the backoff
+	require.Zero(t, tracker.record("a", nil))
+	require.Equal(t, time.Second, tracker.record("a", dialErr))
+	health = tracker.list()
+	require.Equal(t, uint64(1), health[0].Successes)
+	require.Equal(t, 1, health[0].ConsecutiveFailures)
+}
+
+func TestContactPointNext(t *testing.T) {
+	tracker := newContactPointTracker(time.Minute, time.Hour)
+	contactPoints := []string{"a", "b", "c"}
+
+	// Round-robin
+	require.Equal(t, "b", tracker.next(contactPoints))
+	require.Equal(t, "c", tracker.next(contactPoints))
+	require.Equal(t, "a", tracker.next(contactPoints))
+
+	// Skipped contact points are passed over
+	tracker.record("b", errors.New("dial failed"))
+	require.Equal(t, "c", tracker.next(contactPoints))
+	require.Equal(t, "a", tracker.next(contactPoints))
+	require.Equal(t, "c", tracker.next(contactPoints))
+
+	// When all are skipped, the one skipped for the shortest time is chosen
+	tracker.record("c", errors.New("dial failed"))
+	tracker.record("c", errors.New("dial failed"))
+	tracker.record("a", errors.New("dial failed"))
+	tracker.record("a", errors.New("dial failed"))
+	require.Equal(t, "b", tracker.next(contactPoints))
+	require.Equal(t, "b", tracker.next(contactPoints))
+}
+
+func TestContactPointSync(t *testing.T) {
+	tracker := newContactPointTracker(time.Second, time.Minute)
+	tracker.next([]string{"a", "b"})
+	tracker.record("b", errors.New("dial failed"))
+	require.Len(t, tracker.list(), 2)
+
+	// Contact points removed from the metadata are forgotten
+	tracker.next([]string{"a", "c"})
+	health := tracker.list()
+	require.Len(t, health, 2)
+	require.Equal(t, "a", health[0].HostID)
+	require.Equal(t, "c", health[1].HostID)
+
+	// Including their failures if they come back
+	tracker.next([]string{"b"})
+	health = tracker.list()
+	require.Len(t, health, 1)
+	require.Zero(t, health[0].Failures)
+	require.True(t, health[0].SkippedUntil.IsZero())
+}
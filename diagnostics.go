@@ -0,0 +1,113 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+)
+
+// KeyLogFileEnv is the environment variable naming the file TLS secrets are written to by WithKeyLogFromEnvironment.
+const KeyLogFileEnv = "SSLKEYLOGFILE"
+
+// VerificationStep is a step of the verification of the certificates presented by Astra.
+type VerificationStep string
+
+const (
+	// VerificationStepParse is the parsing of the certificates.
+	VerificationStepParse VerificationStep = "parse"
+	// VerificationStepChain is the verification of the chain against the bundle's CA and host.
+	VerificationStepChain VerificationStep = "chain"
+	// VerificationStepSPKIPin is the check of the SPKI pins set by WithSPKIPins.
+	VerificationStepSPKIPin VerificationStep = "spki_pin"
+	// VerificationStepCallback is the callback set by WithVerifyCertificate.
+	VerificationStepCallback VerificationStep = "callback"
+)
+
+// CertificateVerificationError is returned, wrapped, when the certificates presented by Astra fail verification. It
+// tells which step failed.
+type CertificateVerificationError struct {
+	Step VerificationStep
+	// HostID is the node being dialed, it's empty for the Astra metadata service.
+	HostID string
+	// Certificate is the leaf certificate presented by Astra, if it could be parsed.
+	Certificate *x509.Certificate
+	Err         error
+}
+
+func (e *CertificateVerificationError) Error() string {
+	return fmt.Sprintf("Astra certificate verification failed at step %s: %v", e.Step, e.Err)
+}
+
+func (e *CertificateVerificationError) Unwrap() error {
+	return e.Err
+}
+
+// openKeyLogFile opens the file named by KeyLogFileEnv for appending.
+func openKeyLogFile() (*os.File, error) {
+	path := os.Getenv(KeyLogFileEnv)
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open TLS key log file %s: %w", path, err)
+	}
+	return file, nil
+}
+
+// logHandshake logs the parameters of a successful TLS handshake with hostId at debug level.
+func (d *dialer) logHandshake(hostId, addr string, state tls.ConnectionState) {
+	fields := []gocql.LogField{
+		gocql.NewLogFieldString("host_id", hostId),
+		gocql.NewLogFieldString("sni_proxy_addr", addr),
+		gocql.NewLogFieldString("tls_version", tlsVersionName(state.Version)),
+		gocql.NewLogFieldString("cipher_suite", tls.CipherSuiteName(state.CipherSuite)),
+		gocql.NewLogFieldString("alpn", state.NegotiatedProtocol),
+		gocql.NewLogFieldBool("resumed", state.DidResume),
+	}
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		fields = append(fields,
+			gocql.NewLogFieldString("server_cert_subject", leaf.Subject.String()),
+			gocql.NewLogFieldString("server_cert_not_after", leaf.NotAfter.Format(time.RFC3339)))
+	}
+	d.logger.Debug("Completed TLS handshake with Astra node.", fields...)
+}
+
+// logHandshakeFailure logs why a TLS handshake with hostId failed at debug level.
+func (d *dialer) logHandshakeFailure(hostId, addr string, err error) {
+	fields := []gocql.LogField{
+		gocql.NewLogFieldString("host_id", hostId),
+		gocql.NewLogFieldString("sni_proxy_addr", addr),
+	}
+	var verifyErr *CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		fields = append(fields, gocql.NewLogFieldString("verification_step", string(verifyErr.Step)))
+		if leaf := verifyErr.Certificate; leaf != nil {
+			fields = append(fields,
+				gocql.NewLogFieldString("server_cert_subject", leaf.Subject.String()),
+				gocql.NewLogFieldString("server_cert_issuer", leaf.Issuer.String()),
+				gocql.NewLogFieldString("server_cert_not_after", leaf.NotAfter.Format(time.RFC3339)))
+		}
+	}
+	d.logger.Debug("TLS handshake with Astra node failed.", append(fields, gocql.NewLogFieldError("error", err))...)
+}
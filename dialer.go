@@ -16,16 +16,15 @@ package gocqlastra
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"net/http"
-	"strings"
+	"net/url"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -36,91 +35,280 @@ import (
 
 const AstraAPIURL = "https://api.astra.datastax.com"
 
+// AstraDialer is a gocql.HostDialer that connects to an Astra database and exposes the metadata it resolved from
+// the Astra metadata service.
+type AstraDialer interface {
+	gocql.HostDialer
+
+	// Metadata returns the Astra metadata used to dial the database, resolving it first if it hasn't been yet.
+	Metadata(ctx context.Context) (*Metadata, error)
+
+	// AvoidedAddresses returns the SNI proxy addresses that recently failed and are skipped until their cooldown
+	// expires.
+	AvoidedAddresses() []AvoidedAddress
+
+	// ContactPointHealth returns the dial history of the contact points used to bootstrap connections.
+	ContactPointHealth() []ContactPointHealth
+
+	// Certificates returns the certificates of the secure connect bundle in use, with their validity period. The CA
+	// certificates are only included when the bundle was loaded from its zip file.
+	Certificates() []BundleCertificate
+
+	// HandshakeStats returns how many TLS handshakes with Astra nodes were full or resumed a cached session.
+	HandshakeStats() HandshakeStats
+
+	// Close stops the background work of the dialer, such as reloading the secure connect bundle. Connections that
+	// were already dialed aren't affected.
+	Close() error
+}
+
 type dialer struct {
-	sniProxyAddr      string   // Don't use directly
-	contactPoints     []string // Don't use directly
-	contactPointIndex int32
-	bundle            *astra.Bundle
-	dialer            net.Dialer
-	mu                sync.Mutex
-	timeout           time.Duration
-	logger            gocql.StructuredLogger
+	metadata                *astraMetadata // Don't use directly
+	metadataExpiry          time.Time
+	metadataTTL             time.Duration
+	metadataCall            *metadataCall
+	metadataRetryPolicy     RetryPolicy
+	metadataSnapshotPath    string
+	proxy                   func(*http.Request) (*url.URL, error)
+	proxyURL                *url.URL
+	socks5                  *socks5Proxy
+	resolver                *cachingResolver
+	customResolver          Resolver
+	dnsCacheTTL             time.Duration
+	addrCooldowns           *addressCooldowns
+	addrCooldown            time.Duration
+	addrFamily              AddressFamily
+	connectionAttemptDelay  time.Duration
+	contactPoints           *contactPointTracker
+	contactPointBaseBackoff time.Duration
+	contactPointMaxBackoff  time.Duration
+	hostFailures            *hostFailureTracker
+	unknownHostThreshold    int
+	bundle                  atomic.Pointer[LoadedBundle]
+	bundleReloadInterval    time.Duration
+	bundleCacheDir          string
+	tokenProvider           TokenProvider
+	certExpiryWarnings      []time.Duration
+	certExpiryMonitor       *certificateExpiryMonitor
+	rejectExpiredBundle     bool
+	spkiPinValues           []string
+	spkiPins                map[[sha256.Size]byte]struct{}
+	verifyCertificate       VerifyCertificateFunc
+	tlsPolicy               TLSPolicy
+	keyLogWriter            io.Writer
+	keyLogFromEnv           bool
+	keyLogFile              *os.File
+	sessionCacheSize        int
+	sessionCache            *tlsSessionCache
+	fullHandshakes          atomic.Uint64
+	resumedHandshakes       atomic.Uint64
+	closed                  chan struct{}
+	closeOnce               sync.Once
+	netDial                 dialContextFunc
+	mu                      sync.Mutex
+	timeout                 time.Duration
+	logger                  gocql.StructuredLogger
+}
+
+func NewDialerFromBundle(path string, timeout time.Duration, opts ...DialerOption) (AstraDialer, error) {
+	return NewDialerFromBundleWithLogger(path, timeout, nil, opts...)
 }
 
-func NewDialerFromBundle(path string, timeout time.Duration) (gocql.HostDialer, error) {
-	return NewDialerFromBundleWithLogger(path, timeout, nil)
+func NewDialerFromURL(url, databaseID, token string, timeout time.Duration, opts ...DialerOption) (AstraDialer, error) {
+	return NewDialerFromURLWithLogger(url, databaseID, token, timeout, nil, opts...)
 }
 
-func NewDialerFromURL(url, databaseID, token string, timeout time.Duration) (gocql.HostDialer, error) {
-	return NewDialerFromURLWithLogger(url, databaseID, token, timeout, nil)
+func NewDialerFromSource(source BundleSource, timeout time.Duration, opts ...DialerOption) (AstraDialer, error) {
+	return NewDialerFromSourceWithLogger(source, timeout, nil, opts...)
 }
 
-func NewDialer(b *astra.Bundle, timeout time.Duration) (gocql.HostDialer, error) {
-	return NewDialerWithLogger(b, timeout, nil)
+func NewDialerFromBundleBytes(data []byte, timeout time.Duration, opts ...DialerOption) (AstraDialer, error) {
+	return NewDialerFromBundleBytesWithLogger(data, timeout, nil, opts...)
 }
 
-func NewDialerFromBundleWithLogger(path string, timeout time.Duration, logger gocql.StructuredLogger) (gocql.HostDialer, error) {
-	bundle, err := astra.LoadBundleZipFromPath(path)
+func NewDialerFromBundleReader(r io.Reader, timeout time.Duration, opts ...DialerOption) (AstraDialer, error) {
+	return NewDialerFromBundleReaderWithLogger(r, timeout, nil, opts...)
+}
+
+func NewDialerFromBundleEnv(name string, timeout time.Duration, opts ...DialerOption) (AstraDialer, error) {
+	return NewDialerFromBundleEnvWithLogger(name, timeout, nil, opts...)
+}
+
+func NewDialer(b *astra.Bundle, timeout time.Duration, opts ...DialerOption) (AstraDialer, error) {
+	return NewDialerWithLogger(b, timeout, nil, opts...)
+}
+
+func NewDialerFromBundleWithLogger(path string, timeout time.Duration, logger gocql.StructuredLogger, opts ...DialerOption) (AstraDialer, error) {
+	return NewDialerFromSourceWithLogger(&FileBundleSource{Path: path}, timeout, logger, opts...)
+}
+
+func NewDialerFromURLWithLogger(url, databaseID, token string, timeout time.Duration, logger gocql.StructuredLogger, opts ...DialerOption) (AstraDialer, error) {
+	settings := peekDialerOptions(opts)
+	source := &URLBundleSource{
+		URL:           url,
+		DatabaseID:    databaseID,
+		Token:         token,
+		TokenProvider: settings.tokenProvider,
+		Timeout:       timeout,
+		CacheDir:      settings.bundleCacheDir,
+		Logger:        logger,
+		HTTPClient:    settings.httpClient(),
+	}
+	return NewDialerFromSourceWithLogger(source, timeout, logger, opts...)
+}
+
+// NewDialerFromSourceWithLogger creates a dialer using the bundle loaded from source. The load is bounded by timeout.
+// The bundle is loaded again periodically when the dialer is configured with WithBundleReload.
+func NewDialerFromSourceWithLogger(source BundleSource, timeout time.Duration, logger gocql.StructuredLogger, opts ...DialerOption) (AstraDialer, error) {
+	return newDialerFromSource(source, timeout, logger, opts)
+}
+
+func newDialerFromSource(source BundleSource, timeout time.Duration, logger gocql.StructuredLogger, opts []DialerOption) (*dialer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	loaded, err := source.LoadBundle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDialer(loaded, timeout, logger, opts)
 	if err != nil {
 		return nil, err
 	}
-	return NewDialerWithLogger(bundle, timeout, logger)
+	d.startBundleReload(source, loaded.Version)
+	return d, nil
 }
 
-func NewDialerFromURLWithLogger(url, databaseID, token string, timeout time.Duration, logger gocql.StructuredLogger) (gocql.HostDialer, error) {
-	bundle, err := astra.LoadBundleZipFromURL(url, databaseID, token, timeout)
+func NewDialerFromBundleBytesWithLogger(data []byte, timeout time.Duration, logger gocql.StructuredLogger, opts ...DialerOption) (AstraDialer, error) {
+	loaded, err := loadBundleBytes(data)
 	if err != nil {
 		return nil, err
 	}
-	return NewDialerWithLogger(bundle, timeout, logger)
+	return newDialer(loaded, timeout, logger, opts)
 }
 
-func NewDialerWithLogger(b *astra.Bundle, timeout time.Duration, logger gocql.StructuredLogger) (gocql.HostDialer, error) {
-	if logger == nil {
-		logger = emptyLoggerSingleton
+func NewDialerFromBundleReaderWithLogger(r io.Reader, timeout time.Duration, logger gocql.StructuredLogger, opts ...DialerOption) (AstraDialer, error) {
+	loaded, err := loadBundleReader(r)
+	if err != nil {
+		return nil, err
 	}
-	return &dialer{
-		bundle:  b,
-		timeout: timeout,
-		logger:  logger,
-	}, nil
+	return newDialer(loaded, timeout, logger, opts)
 }
 
-func (d *dialer) DialHost(ctx context.Context, host *gocql.HostInfo) (*gocql.DialedHost, error) {
-	sniAddr, contactPoints, err := d.resolveMetadata(ctx)
+func NewDialerFromBundleEnvWithLogger(name string, timeout time.Duration, logger gocql.StructuredLogger, opts ...DialerOption) (AstraDialer, error) {
+	loaded, err := loadBundleEnv(name)
 	if err != nil {
 		return nil, err
 	}
+	return newDialer(loaded, timeout, logger, opts)
+}
+
+func NewDialerWithLogger(b *astra.Bundle, timeout time.Duration, logger gocql.StructuredLogger, opts ...DialerOption) (AstraDialer, error) {
+	return newDialer(NewLoadedBundle(b), timeout, logger, opts)
+}
+
+func newDialer(loaded *LoadedBundle, timeout time.Duration, logger gocql.StructuredLogger, opts []DialerOption) (*dialer, error) {
+	if logger == nil {
+		logger = emptyLoggerSingleton
+	}
+	d := &dialer{
+		closed:                  make(chan struct{}),
+		timeout:                 timeout,
+		logger:                  logger,
+		metadataRetryPolicy:     DefaultRetryPolicy(),
+		netDial:                 (&net.Dialer{}).DialContext,
+		dnsCacheTTL:             DefaultDNSCacheTTL,
+		addrCooldown:            DefaultAddressCooldown,
+		connectionAttemptDelay:  DefaultConnectionAttemptDelay,
+		contactPointBaseBackoff: DefaultContactPointBaseBackoff,
+		contactPointMaxBackoff:  DefaultContactPointMaxBackoff,
+		unknownHostThreshold:    DefaultUnknownHostThreshold,
+		certExpiryWarnings:      DefaultCertificateExpiryWarnings,
+		sessionCacheSize:        DefaultTLSSessionCacheSize,
+	}
+	d.bundle.Store(loaded)
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.resolver = newCachingResolver(d.customResolver, d.dnsCacheTTL)
+	d.addrCooldowns = newAddressCooldowns(d.addrCooldown)
+	d.contactPoints = newContactPointTracker(d.contactPointBaseBackoff, d.contactPointMaxBackoff)
+	d.hostFailures = newHostFailureTracker(d.unknownHostThreshold)
+	d.certExpiryMonitor = newCertificateExpiryMonitor(d.certExpiryWarnings)
+	var err error
+	if d.proxyURL != nil {
+		if err = checkProxyURL(d.proxyURL); err != nil {
+			return nil, err
+		}
+	}
+	if d.spkiPins, err = parseSPKIPins(d.spkiPinValues); err != nil {
+		return nil, err
+	}
+	if err = d.tlsPolicy.validate(); err != nil {
+		return nil, err
+	}
+	if err = d.tlsPolicy.validateBundle(loaded); err != nil {
+		return nil, err
+	}
+	if d.keyLogFromEnv && d.keyLogWriter == nil {
+		if d.keyLogFile, err = openKeyLogFile(); err != nil {
+			return nil, err
+		}
+		if d.keyLogFile != nil {
+			d.keyLogWriter = d.keyLogFile
+		}
+	}
+	if d.keyLogWriter != nil {
+		d.logger.Warning("TLS key logging is enabled for Astra connections, traffic can be decrypted by anyone " +
+			"with access to the key log.")
+	}
+	if d.sessionCacheSize > 0 {
+		d.sessionCache = newTLSSessionCache(d.sessionCacheSize)
+	}
+	if d.rejectExpiredBundle {
+		if err = checkCertificatesValid(bundleCertificates(loaded), time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	d.checkCertificateExpiry()
+	return d, nil
+}
+
+func (d *dialer) DialHost(ctx context.Context, host *gocql.HostInfo) (*gocql.DialedHost, error) {
+	d.checkCertificateExpiryIfDue()
 
-	addr, err := lookupHost(sniAddr)
+	metadata, err := d.resolveMetadata(ctx)
 	if err != nil {
 		return nil, err
 	}
+	sniAddr, contactPoints := metadata.ContactInfo.SniProxyAddress, metadata.ContactInfo.ContactPoints
 
 	hostId := host.HostID()
-	if hostId == "" {
-		hostId = contactPoints[int(atomic.AddInt32(&d.contactPointIndex, 1))%len(d.contactPoints)]
+	isContactPoint := hostId == ""
+	if isContactPoint {
+		hostId = d.contactPoints.next(contactPoints)
 		d.logger.Debug("Dialing Astra contact point.",
 			gocql.NewLogFieldString("host_id", hostId),
 			gocql.NewLogFieldIP("original_gocql_contact_point", host.ConnectAddress()),
-			gocql.NewLogFieldString("sni_proxy_hostname", sniAddr),
-			gocql.NewLogFieldString("sni_proxy_addr", addr))
+			gocql.NewLogFieldString("sni_proxy_hostname", sniAddr))
 	} else {
 		d.logger.Debug("Dialing Astra node.",
 			gocql.NewLogFieldString("host_id", hostId),
-			gocql.NewLogFieldString("sni_proxy_hostname", sniAddr),
-			gocql.NewLogFieldString("sni_proxy_addr", addr))
+			gocql.NewLogFieldString("sni_proxy_hostname", sniAddr))
 	}
 
-	conn, err := d.dialer.DialContext(ctx, "tcp", addr)
-	if err != nil {
-		return nil, fmt.Errorf("error connecting to Astra ingress %v: %w", addr, err)
+	tlsConn, addr, err := d.dialIngress(ctx, sniAddr, hostId)
+	if isContactPoint && (err == nil || ctx.Err() == nil) {
+		if backoff := d.contactPoints.record(hostId, err); backoff > 0 {
+			d.logger.Warning("Astra contact point failed, skipping it.",
+				gocql.NewLogFieldString("host_id", hostId),
+				gocql.NewLogFieldString("backoff", backoff.String()),
+				gocql.NewLogFieldError("error", err))
+		}
+	} else if !isContactPoint && ctx.Err() == nil {
+		err = d.checkUnknownHost(ctx, sniAddr, hostId, err)
 	}
-
-	tlsConn := tls.Client(conn, copyTLSConfig(d.bundle, hostId))
-	if err = tlsConn.HandshakeContext(ctx); err != nil {
-		_ = conn.Close()
-		return nil, fmt.Errorf("error connecting to Astra node %v through ingress %v: %w", hostId, addr, err)
+	if err != nil {
+		return nil, err
 	}
 
 	d.logger.Debug("Successfully dialed Astra node or contact point.",
@@ -134,89 +322,60 @@ func (d *dialer) DialHost(ctx context.Context, host *gocql.HostInfo) (*gocql.Dia
 	}, nil
 }
 
-func (d *dialer) resolveMetadata(ctx context.Context) (string, []string, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	// TODO: Make this value have a TTL
-	if d.sniProxyAddr != "" {
-		return d.sniProxyAddr, d.contactPoints, nil
+// dialContext opens every outbound connection made by the dialer, going through the SOCKS5 proxy when one is
+// configured.
+func (d *dialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.socks5 != nil {
+		return d.socks5.dialContext(ctx, d.netDial, network, addr)
 	}
+	return d.netDial(ctx, network, addr)
+}
 
-	var metadata *astraMetadata
-
-	ctx, cancel := context.WithTimeout(ctx, d.timeout)
-	defer cancel()
-
-	httpsClient := &http.Client{
+// httpClient returns a client for the Astra DevOps API whose connections go through the dialer's proxy and dial
+// function.
+func (d *dialer) httpClient() *http.Client {
+	return &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: d.bundle.TLSConfig.Clone(),
+			Proxy:             d.proxy,
+			DialContext:       d.dialContext,
+			ForceAttemptHTTP2: true,
 		},
 	}
+}
 
-	url := fmt.Sprintf("https://%s:%d/metadata", d.bundle.Host, d.bundle.Port)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
-	if err != nil {
-		return "", nil, err
-	}
-
-	response, err := httpsClient.Do(req)
-	if err != nil {
-		d.logger.Debug("Unable to retrieve Astra metadata.",
-			gocql.NewLogFieldString("url", url),
-			gocql.NewLogFieldError("error", err))
-		return "", nil, fmt.Errorf("unable to get Astra metadata from %s: %w", url, err)
-	}
+func (d *dialer) AvoidedAddresses() []AvoidedAddress {
+	return d.addrCooldowns.list()
+}
 
-	body, err := readAllWithTimeout(response.Body, ctx)
-	if err != nil {
-		d.logger.Debug("Unable to retrieve Astra metadata response body.",
-			gocql.NewLogFieldInt("status_code", response.StatusCode),
-			gocql.NewLogFieldString("url", url),
-			gocql.NewLogFieldError("error", err))
-		return "", nil, fmt.Errorf("unable to read Astra metadata response body from %s: %w, http code: %v", url, err, response.StatusCode)
-	}
+func (d *dialer) ContactPointHealth() []ContactPointHealth {
+	return d.contactPoints.list()
+}
 
-	err = json.Unmarshal(body, &metadata)
+func (d *dialer) Metadata(ctx context.Context) (*Metadata, error) {
+	metadata, err := d.resolveMetadata(ctx)
 	if err != nil {
-		d.logger.Debug("Unable to decode Astra metadata response body.",
-			gocql.NewLogFieldInt("status_code", response.StatusCode),
-			gocql.NewLogFieldString("response_body", string(body)),
-			gocql.NewLogFieldString("url", url),
-			gocql.NewLogFieldError("error", err))
-		return "", nil, fmt.Errorf("unable to decode Astra metadata response body from %s: %w, received body: %v, http code: %v", url, err, string(body), response.StatusCode)
-	}
-
-	d.logger.Debug("Successfully retrieved and decoded Astra metadata.",
-		gocql.NewLogFieldInt("status_code", response.StatusCode),
-		gocql.NewLogFieldString("response_body", string(body)),
-		gocql.NewLogFieldString("url", url),
-		gocql.NewLogFieldError("error", err))
-
-	if metadata.ContactInfo.SniProxyAddress == "" || len(metadata.ContactInfo.ContactPoints) == 0 {
-		return "", nil, fmt.Errorf("unable to decode Astra metadata response body from %s: %w, received body: %v, http code: %v", url, err, string(body), response.StatusCode)
+		return nil, err
 	}
-
-	d.sniProxyAddr = metadata.ContactInfo.SniProxyAddress
-	d.contactPoints = metadata.ContactInfo.ContactPoints
-
-	d.logger.Debug("Successfully resolved Astra metadata.",
-		gocql.NewLogFieldString("sni_proxy_addr", d.sniProxyAddr),
-		gocql.NewLogFieldString("contact_points", strings.Join(d.contactPoints, ",")))
-
-	return d.sniProxyAddr, d.contactPoints, nil
+	return metadata.public(), nil
 }
 
-func copyTLSConfig(bundle *astra.Bundle, serverName string) *tls.Config {
+// copyTLSConfig returns the TLS configuration to reach the node serverName through the SNI proxy. The server
+// certificate is verified against the bundle host, rather than the node, and then by verify, if it isn't nil.
+// Verification failures are returned as a CertificateVerificationError.
+func copyTLSConfig(bundle *astra.Bundle, serverName string, verify func(verifiedChains [][]*x509.Certificate) error) *tls.Config {
 	tlsConfig := bundle.TLSConfig.Clone()
 	tlsConfig.ServerName = serverName
 	tlsConfig.InsecureSkipVerify = true
-	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
 		certs := make([]*x509.Certificate, len(rawCerts))
 		for i, asn1Data := range rawCerts {
 			cert, err := x509.ParseCertificate(asn1Data)
 			if err != nil {
-				return errors.New("tls: failed to parse certificate from server: " + err.Error())
+				return &CertificateVerificationError{
+					Step:   VerificationStepParse,
+					HostID: serverName,
+					Err:    errors.New("tls: failed to parse certificate from server: " + err.Error()),
+				}
 			}
 			certs[i] = cert
 		}
@@ -230,9 +389,14 @@ func copyTLSConfig(bundle *astra.Bundle, serverName string) *tls.Config {
 		for _, cert := range certs[1:] {
 			opts.Intermediates.AddCert(cert)
 		}
-		var err error
-		verifiedChains, err = certs[0].Verify(opts)
-		return err
+		verifiedChains, err := certs[0].Verify(opts)
+		if err != nil {
+			return &CertificateVerificationError{Step: VerificationStepChain, HostID: serverName, Certificate: certs[0], Err: err}
+		}
+		if verify != nil {
+			return verify(verifiedChains)
+		}
+		return nil
 	}
 	return tlsConfig
 }
@@ -254,35 +418,6 @@ func readAllWithTimeout(r io.Reader, ctx context.Context) (bytes []byte, err err
 	return bytes, err
 }
 
-func lookupHost(hostWithPort string) (string, error) {
-	host, port, err := net.SplitHostPort(hostWithPort)
-	if err != nil {
-		return "", err
-	}
-	addrs, err := net.LookupHost(host)
-	if err != nil {
-		return "", err
-	}
-	addr := addrs[rand.Intn(len(addrs))]
-	if len(port) > 0 {
-		addr = net.JoinHostPort(addr, port)
-	}
-	return addr, nil
-}
-
-type contactInfo struct {
-	TypeName        string   `json:"type"`
-	LocalDc         string   `json:"local_dc"`
-	SniProxyAddress string   `json:"sni_proxy_address"`
-	ContactPoints   []string `json:"contact_points"`
-}
-
-type astraMetadata struct {
-	Version     int         `json:"version"`
-	Region      string      `json:"region"`
-	ContactInfo contactInfo `json:"contact_info"`
-}
-
 var emptyLoggerSingleton = &emptyLogger{}
 
 type emptyLogger struct{}
@@ -0,0 +1,81 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDialer creates a dialer for loaded through newDialer, so it has the same defaults as the dialers of the
+// public constructors, except that failed metadata requests aren't retried. It's closed when the test ends.
+func newTestDialer(t *testing.T, loaded *LoadedBundle, opts ...DialerOption) *dialer {
+	t.Helper()
+	opts = append([]DialerOption{WithMetadataRetryPolicy(RetryPolicy{MaxAttempts: 1})}, opts...)
+	d, err := newDialer(loaded, time.Second, nil, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = d.Close()
+	})
+	return d
+}
+
+// closedPort returns a local port that nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+	return port
+}
+
+// unreachableBundle returns a bundle whose metadata service can't be reached.
+func unreachableBundle(t *testing.T) *LoadedBundle {
+	t.Helper()
+	return newTestCA(t).loadedBundle(t, "127.0.0.1", closedPort(t))
+}
+
+// startTestServer starts an HTTPS server on 127.0.0.1 with a certificate issued by ca. It's closed when the test
+// ends.
+func startTestServer(t *testing.T, ca *testCA, handler http.Handler) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.certificate(t, x509.ExtKeyUsageServerAuth, "127.0.0.1")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// serverBundle returns a bundle, issued by ca, whose metadata service is server.
+func serverBundle(t *testing.T, ca *testCA, server *httptest.Server) *LoadedBundle {
+	t.Helper()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	return ca.loadedBundle(t, addr.IP.String(), addr.Port)
+}
@@ -0,0 +1,248 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+	"github.com/datastax/cql-proxy/astra"
+)
+
+// FailoverPolicy controls when a FailoverDialer switches between regions.
+type FailoverPolicy struct {
+	// FailureThreshold is the number of consecutive dials through the active region that failed to resolve the
+	// metadata or to connect to the SNI proxy after which the dialer fails over to the next region. Failed TLS
+	// handshakes with a single node aren't counted. Values less than 1 are treated as 1.
+	FailureThreshold int
+	// RecoveryPeriod is how long the dialer waits after failing over before it tries the primary region again.
+	// Zero disables switching back to the primary region.
+	RecoveryPeriod time.Duration
+}
+
+// DefaultFailoverPolicy returns a policy that fails over after three consecutive failed dials and tries the primary
+// region again after five minutes.
+func DefaultFailoverPolicy() FailoverPolicy {
+	return FailoverPolicy{
+		FailureThreshold: 3,
+		RecoveryPeriod:   5 * time.Minute,
+	}
+}
+
+// FailoverDialer is an AstraDialer for multi-region databases. It's created from an ordered list of secure connect
+// bundles, one per region, and dials through the first (primary) region's SNI proxy. When dialing through the active
+// region keeps failing, either because its metadata can't be fetched or because its ingress can't be reached, it
+// fails over to the next region. After the policy's recovery period it tries the primary region again and switches
+// back to it as soon as a dial succeeds.
+type FailoverDialer struct {
+	regions []*dialer
+	policy  FailoverPolicy
+	logger  gocql.StructuredLogger
+
+	mu                  sync.Mutex
+	active              int
+	consecutiveFailures int
+	failedOverAt        time.Time
+}
+
+var _ AstraDialer = (*FailoverDialer)(nil)
+
+func NewFailoverDialerFromBundles(paths []string, timeout time.Duration, policy FailoverPolicy, opts ...DialerOption) (*FailoverDialer, error) {
+	return NewFailoverDialerFromBundlesWithLogger(paths, timeout, policy, nil, opts...)
+}
+
+func NewFailoverDialer(bundles []*astra.Bundle, timeout time.Duration, policy FailoverPolicy, opts ...DialerOption) (*FailoverDialer, error) {
+	return NewFailoverDialerWithLogger(bundles, timeout, policy, nil, opts...)
+}
+
+func NewFailoverDialerFromBundlesWithLogger(paths []string, timeout time.Duration, policy FailoverPolicy, logger gocql.StructuredLogger, opts ...DialerOption) (*FailoverDialer, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("at least one secure connect bundle is required")
+	}
+	regions := make([]*dialer, 0, len(paths))
+	for _, path := range paths {
+		region, err := newDialerFromSource(&FileBundleSource{Path: path}, timeout, logger, opts)
+		if err != nil {
+			for _, r := range regions {
+				_ = r.Close()
+			}
+			return nil, err
+		}
+		regions = append(regions, region)
+	}
+	return newFailoverDialer(regions, policy, logger), nil
+}
+
+func NewFailoverDialerWithLogger(bundles []*astra.Bundle, timeout time.Duration, policy FailoverPolicy, logger gocql.StructuredLogger, opts ...DialerOption) (*FailoverDialer, error) {
+	if len(bundles) == 0 {
+		return nil, errors.New("at least one secure connect bundle is required")
+	}
+	regions := make([]*dialer, 0, len(bundles))
+	for _, bundle := range bundles {
+		region, err := newDialer(NewLoadedBundle(bundle), timeout, logger, opts)
+		if err != nil {
+			for _, r := range regions {
+				_ = r.Close()
+			}
+			return nil, err
+		}
+		regions = append(regions, region)
+	}
+	return newFailoverDialer(regions, policy, logger), nil
+}
+
+func newFailoverDialer(regions []*dialer, policy FailoverPolicy, logger gocql.StructuredLogger) *FailoverDialer {
+	if logger == nil {
+		logger = emptyLoggerSingleton
+	}
+	if policy.FailureThreshold < 1 {
+		policy.FailureThreshold = 1
+	}
+	return &FailoverDialer{
+		regions: regions,
+		policy:  policy,
+		logger:  logger,
+	}
+}
+
+func (f *FailoverDialer) DialHost(ctx context.Context, host *gocql.HostInfo) (*gocql.DialedHost, error) {
+	region := f.selectRegion()
+	dialed, err := f.regions[region].DialHost(ctx, host)
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up, that says nothing about the health of the region.
+		return nil, err
+	}
+	f.recordResult(region, err)
+	return dialed, err
+}
+
+// Metadata returns the Astra metadata of the active region.
+func (f *FailoverDialer) Metadata(ctx context.Context) (*Metadata, error) {
+	return f.regions[f.ActiveRegion()].Metadata(ctx)
+}
+
+// ActiveRegion returns the index, in the list of bundles the dialer was created with, of the region currently used
+// to dial the database. The primary region has index 0.
+func (f *FailoverDialer) ActiveRegion() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// selectRegion returns the region to dial through: the active region, or the primary region once the recovery
+// period has elapsed since failing over.
+func (f *FailoverDialer) selectRegion() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active != 0 && f.policy.RecoveryPeriod > 0 && time.Since(f.failedOverAt) >= f.policy.RecoveryPeriod {
+		return 0
+	}
+	return f.active
+}
+
+func (f *FailoverDialer) recordResult(region int, err error) {
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		// The SNI proxy was reached, only the node failed. UnknownHostError also wraps a handshakeError.
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		if region != f.active {
+			f.logger.Info("Primary Astra region recovered, switching back.",
+				gocql.NewLogFieldInt("from_region", f.active),
+				gocql.NewLogFieldInt("to_region", region))
+			f.active = region
+		}
+		f.consecutiveFailures = 0
+		return
+	}
+
+	if region != f.active {
+		// The primary region is still unavailable, wait another recovery period before trying it again.
+		f.failedOverAt = time.Now()
+		f.logger.Debug("Primary Astra region is still unavailable.",
+			gocql.NewLogFieldInt("active_region", f.active),
+			gocql.NewLogFieldError("error", err))
+		return
+	}
+
+	f.consecutiveFailures++
+	if f.consecutiveFailures < f.policy.FailureThreshold || len(f.regions) == 1 {
+		return
+	}
+	next := (f.active + 1) % len(f.regions)
+	f.logger.Warning("Dialing through Astra region keeps failing, failing over to the next region.",
+		gocql.NewLogFieldInt("from_region", f.active),
+		gocql.NewLogFieldInt("to_region", next),
+		gocql.NewLogFieldInt("consecutive_failures", f.consecutiveFailures),
+		gocql.NewLogFieldError("error", err))
+	f.active = next
+	f.consecutiveFailures = 0
+	f.failedOverAt = time.Now()
+}
+
+// AvoidedAddresses returns the SNI proxy addresses of every region that recently failed and are skipped until their
+// cooldown expires.
+func (f *FailoverDialer) AvoidedAddresses() []AvoidedAddress {
+	var avoided []AvoidedAddress
+	for _, region := range f.regions {
+		avoided = append(avoided, region.AvoidedAddresses()...)
+	}
+	return avoided
+}
+
+// ContactPointHealth returns the dial history of the contact points of every region.
+func (f *FailoverDialer) ContactPointHealth() []ContactPointHealth {
+	var health []ContactPointHealth
+	for _, region := range f.regions {
+		health = append(health, region.ContactPointHealth()...)
+	}
+	return health
+}
+
+// Certificates returns the certificates of the secure connect bundles of every region.
+func (f *FailoverDialer) Certificates() []BundleCertificate {
+	var certs []BundleCertificate
+	for _, region := range f.regions {
+		certs = append(certs, region.Certificates()...)
+	}
+	return certs
+}
+
+// HandshakeStats returns the TLS handshake counts of every region combined.
+func (f *FailoverDialer) HandshakeStats() HandshakeStats {
+	var stats HandshakeStats
+	for _, region := range f.regions {
+		regionStats := region.HandshakeStats()
+		stats.Full += regionStats.Full
+		stats.Resumed += regionStats.Resumed
+	}
+	return stats
+}
+
+// Close stops the background work of the dialers of every region.
+func (f *FailoverDialer) Close() error {
+	for _, region := range f.regions {
+		_ = region.Close()
+	}
+	return nil
+}
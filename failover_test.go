@@ -0,0 +1,47 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverDialerRecordResult(t *testing.T) {
+	f := newFailoverDialer([]*dialer{{}, {}}, FailoverPolicy{FailureThreshold: 2}, nil)
+	connectErr := errors.New("error connecting to Astra ingress: connection refused")
+	hsErr := &handshakeError{hostId: "host", addr: "ingress:29042", err: errors.New("tls: unrecognized name")}
+
+	f.recordResult(0, connectErr)
+	// Node-specific failures neither count nor reset the count
+	f.recordResult(0, hsErr)
+	f.recordResult(0, fmt.Errorf("all 2 addresses failed, last error: %w", hsErr))
+	f.recordResult(0, &UnknownHostError{HostID: "host", Failures: 3, Err: hsErr})
+	require.Equal(t, 0, f.ActiveRegion())
+	require.Equal(t, 1, f.consecutiveFailures)
+
+	f.recordResult(0, connectErr)
+	require.Equal(t, 1, f.ActiveRegion())
+	require.Equal(t, 0, f.consecutiveFailures)
+
+	f.recordResult(1, nil)
+	f.recordResult(1, connectErr)
+	f.recordResult(1, nil)
+	f.recordResult(1, connectErr)
+	require.Equal(t, 1, f.ActiveRegion())
+}
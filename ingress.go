@@ -0,0 +1,449 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+)
+
+const (
+	// DefaultAddressCooldown is how long a failed SNI proxy address is skipped by default.
+	DefaultAddressCooldown = 30 * time.Second
+	// DefaultConnectionAttemptDelay is how long to wait by default before racing another SNI proxy address against
+	// the ones being dialed. It's the value recommended by RFC 8305.
+	DefaultConnectionAttemptDelay = 250 * time.Millisecond
+)
+
+// AvoidedAddress is an SNI proxy address that recently failed and is skipped until its cooldown expires.
+type AvoidedAddress struct {
+	// Address is the IP address and port of the SNI proxy.
+	Address string
+	// Until is when the address stops being skipped.
+	Until time.Time
+	// Err is the error of the last failed dial.
+	Err error
+}
+
+// dialIngress opens a TLS connection to hostId through the SNI proxy. The addresses of the SNI proxy hostname are
+// raced until one succeeds, starting with the addresses that didn't fail recently. When an HTTP or SOCKS5 proxy is
+// configured it resolves the SNI proxy hostname, so there is a single connection to attempt. It also returns the
+// address that was dialed, for logging.
+func (d *dialer) dialIngress(ctx context.Context, sniAddr, hostId string) (*tls.Conn, string, error) {
+	proxyURL, err := d.ingressProxy(sniAddr)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to determine the proxy for Astra ingress %v: %w", sniAddr, err)
+	}
+	if proxyURL != nil {
+		conn, err := dialHTTPConnect(ctx, d.dialContext, proxyURL, sniAddr)
+		if err != nil {
+			return nil, "", fmt.Errorf("error connecting to Astra ingress %v through proxy %v: %w", sniAddr, proxyURL.Redacted(), err)
+		}
+		tlsConn, err := d.handshake(ctx, conn, sniAddr, sniAddr, hostId)
+		return tlsConn, sniAddr, err
+	}
+	if d.socks5 != nil {
+		tlsConn, err := d.dialAddr(ctx, sniAddr, sniAddr, hostId)
+		return tlsConn, sniAddr, err
+	}
+
+	addrs, err := d.lookupHost(ctx, sniAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	addrs, err = arrangeAddrs(addrs, d.addrFamily)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to dial Astra ingress %v: %w", sniAddr, err)
+	}
+	addrs, avoided := d.addrCooldowns.order(addrs)
+
+	tlsConn, addr, err := d.raceAddrs(ctx, sniAddr, addrs, avoided, hostId)
+	if err != nil && len(addrs) > 1 {
+		return nil, "", fmt.Errorf("all %d addresses of Astra ingress %v failed, last error: %w", len(addrs), sniAddr, err)
+	}
+	return tlsConn, addr, err
+}
+
+type dialResult struct {
+	conn net.Conn
+	addr string
+	err  error
+}
+
+// raceAddrs connects to the addresses in order, the last avoided ones having recently failed, and returns the first
+// connection to complete its TLS handshake with hostId. Only the TCP connections are raced, the handshake is made
+// on the connection that won. When the handshake fails, the addresses that weren't tried yet, or whose connection
+// lost the race, are raced again.
+func (d *dialer) raceAddrs(ctx context.Context, sniAddr string, addrs []string, avoided int, hostId string) (*tls.Conn, string, error) {
+	var lastErr error
+	for len(addrs) > 0 {
+		conn, addr, failed, err := d.raceConnect(ctx, addrs, avoided, hostId)
+		if err != nil {
+			return nil, "", err
+		}
+		tlsConn, err := d.handshake(ctx, conn, sniAddr, addr, hostId)
+		if err == nil {
+			d.addrCooldowns.clear(addr)
+			return tlsConn, addr, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		if isAddressHandshakeError(err) {
+			d.avoidAddr(addr, err)
+		}
+		failed[addr] = true
+		addrs, avoided = remainingAddrs(addrs, avoided, failed)
+	}
+	return nil, "", lastErr
+}
+
+// raceConnect opens a TCP connection to the first of the addresses to accept it. Following Happy Eyeballs
+// (RFC 8305), an attempt is started every connection attempt delay, or as soon as the previous one fails, while the
+// earlier attempts keep going. A delay of zero or less connects to the addresses one at a time. It also returns the
+// addresses that failed to connect, which are avoided for the cooldown period.
+func (d *dialer) raceConnect(ctx context.Context, addrs []string, avoided int, hostId string) (net.Conn, string, map[string]bool, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	failed := make(map[string]bool)
+	next, pending := 0, 0
+	startNext := func() {
+		addr, attempt := addrs[next], next+1
+		d.logger.Debug("Dialing Astra ingress address.",
+			gocql.NewLogFieldString("host_id", hostId),
+			gocql.NewLogFieldString("sni_proxy_addr", addr),
+			gocql.NewLogFieldInt("attempt", attempt),
+			gocql.NewLogFieldInt("candidates", len(addrs)),
+			gocql.NewLogFieldBool("avoided", next >= len(addrs)-avoided))
+		next++
+		pending++
+		go func() {
+			conn, err := d.dialContext(raceCtx, "tcp", addr)
+			if err != nil {
+				err = fmt.Errorf("error connecting to Astra ingress %v: %w", addr, err)
+			}
+			results <- dialResult{conn: conn, addr: addr, err: err}
+		}()
+	}
+
+	var lastErr error
+	startNext()
+	for pending > 0 {
+		var delay <-chan time.Time
+		var timer *time.Timer
+		if d.connectionAttemptDelay > 0 && next < len(addrs) && ctx.Err() == nil {
+			timer = time.NewTimer(d.connectionAttemptDelay)
+			delay = timer.C
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				cancel()
+				go closeRemaining(results, pending)
+				return r.conn, r.addr, failed, nil
+			}
+			lastErr = r.err
+			failed[r.addr] = true
+			if ctx.Err() == nil {
+				d.avoidAddr(r.addr, r.err)
+				if next < len(addrs) {
+					startNext()
+				}
+			}
+		case <-delay:
+			startNext()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, "", failed, lastErr
+}
+
+// avoidAddr skips addr for the cooldown period after it failed with err.
+func (d *dialer) avoidAddr(addr string, err error) {
+	if until, ok := d.addrCooldowns.avoid(addr, err); ok {
+		d.logger.Warning("Astra ingress address failed, skipping it until its cooldown expires.",
+			gocql.NewLogFieldString("sni_proxy_addr", addr),
+			gocql.NewLogFieldString("until", until.Format(time.RFC3339)),
+			gocql.NewLogFieldError("error", err))
+	}
+}
+
+// remainingAddrs returns the addresses that didn't fail, in the same order, and how many of them are avoided.
+func remainingAddrs(addrs []string, avoided int, failed map[string]bool) ([]string, int) {
+	remaining := make([]string, 0, len(addrs))
+	remainingAvoided := 0
+	for i, addr := range addrs {
+		if failed[addr] {
+			continue
+		}
+		remaining = append(remaining, addr)
+		if i >= len(addrs)-avoided {
+			remainingAvoided++
+		}
+	}
+	return remaining, remainingAvoided
+}
+
+// isAddressHandshakeError reports whether a failed TLS handshake points at the SNI proxy address rather than at the
+// node: the address accepted the connection but doesn't speak TLS or didn't complete the handshake in time. Other
+// failures, such as an alert or the SNI proxy closing the connection because it doesn't know the node, concern the
+// node and would happen through any address.
+func isAddressHandshakeError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// closeRemaining closes the connections of the attempts that were still pending when another one won the race.
+func closeRemaining(results <-chan dialResult, pending int) {
+	for i := 0; i < pending; i++ {
+		if r := <-results; r.conn != nil {
+			_ = r.conn.Close()
+		}
+	}
+}
+
+// AddressFamily selects which IP versions are used to reach the SNI proxy.
+type AddressFamily int
+
+const (
+	// AddressFamilyAny dials IPv4 and IPv6 addresses alternately, starting with the family of a random address.
+	AddressFamilyAny AddressFamily = iota
+	// AddressFamilyPreferIPv4 dials IPv4 and IPv6 addresses alternately, starting with IPv4.
+	AddressFamilyPreferIPv4
+	// AddressFamilyPreferIPv6 dials IPv4 and IPv6 addresses alternately, starting with IPv6.
+	AddressFamilyPreferIPv6
+	// AddressFamilyIPv4Only only dials IPv4 addresses.
+	AddressFamilyIPv4Only
+	// AddressFamilyIPv6Only only dials IPv6 addresses.
+	AddressFamilyIPv6Only
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case AddressFamilyAny:
+		return "any"
+	case AddressFamilyPreferIPv4:
+		return "prefer IPv4"
+	case AddressFamilyPreferIPv6:
+		return "prefer IPv6"
+	case AddressFamilyIPv4Only:
+		return "IPv4 only"
+	case AddressFamilyIPv6Only:
+		return "IPv6 only"
+	default:
+		return fmt.Sprintf("AddressFamily(%d)", int(f))
+	}
+}
+
+// arrangeAddrs orders addrs for dialing according to family: addresses of the preferred family alternate with the
+// addresses of the other family, or the other family is dropped entirely. Addresses that aren't IP literals are
+// kept last.
+func arrangeAddrs(addrs []string, family AddressFamily) ([]string, error) {
+	var ipv4, ipv6, other []string
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		ip := net.ParseIP(host)
+		switch {
+		case ip == nil:
+			other = append(other, addr)
+		case ip.To4() != nil:
+			ipv4 = append(ipv4, addr)
+		default:
+			ipv6 = append(ipv6, addr)
+		}
+	}
+
+	first, second := ipv6, ipv4
+	switch family {
+	case AddressFamilyIPv4Only:
+		first, second, other = ipv4, nil, nil
+	case AddressFamilyIPv6Only:
+		first, second, other = ipv6, nil, nil
+	case AddressFamilyPreferIPv4:
+		first, second = ipv4, ipv6
+	case AddressFamilyAny:
+		if len(ipv4) > 0 && len(addrs) > 0 && addrs[0] == ipv4[0] {
+			first, second = ipv4, ipv6
+		}
+	}
+	if len(first)+len(second)+len(other) == 0 {
+		return nil, fmt.Errorf("no addresses match address family %v", family)
+	}
+
+	arranged := make([]string, 0, len(first)+len(second)+len(other))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			arranged = append(arranged, first[i])
+		}
+		if i < len(second) {
+			arranged = append(arranged, second[i])
+		}
+	}
+	return append(arranged, other...), nil
+}
+
+// dialAddr opens a TLS connection to hostId through the SNI proxy sniAddr, at addr.
+func (d *dialer) dialAddr(ctx context.Context, sniAddr, addr, hostId string) (*tls.Conn, error) {
+	conn, err := d.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Astra ingress %v: %w", addr, err)
+	}
+	return d.handshake(ctx, conn, sniAddr, addr, hostId)
+}
+
+// handshake performs the TLS handshake with hostId over conn, resuming a previous session with the node through the
+// same SNI proxy when possible.
+func (d *dialer) handshake(ctx context.Context, conn net.Conn, sniAddr, addr, hostId string) (*tls.Conn, error) {
+	loaded := d.bundle.Load()
+	tlsConfig := copyTLSConfig(loaded.Bundle, hostId, d.verifyChains(hostId))
+	d.tlsPolicy.apply(tlsConfig)
+	tlsConfig.KeyLogWriter = d.keyLogWriter
+	if d.sessionCache != nil {
+		// Sessions are scoped to the bundle so that a reloaded bundle never resumes a session of the previous one
+		tlsConfig.ClientSessionCache = d.sessionCache.scoped(loaded.Version + "|" + sniAddr + "|")
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		d.logHandshakeFailure(hostId, addr, err)
+		return nil, &handshakeError{hostId: hostId, addr: addr, err: err}
+	}
+	state := tlsConn.ConnectionState()
+	d.logHandshake(hostId, addr, state)
+	if state.DidResume {
+		d.resumedHandshakes.Add(1)
+	} else {
+		d.fullHandshakes.Add(1)
+	}
+	return tlsConn, nil
+}
+
+// handshakeError is returned when the SNI proxy was reached but the TLS handshake with the node failed.
+type handshakeError struct {
+	hostId string
+	addr   string
+	err    error
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("error connecting to Astra node %v through ingress %v: %v", e.hostId, e.addr, e.err)
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+// addressCooldowns tracks the SNI proxy addresses that recently failed.
+type addressCooldowns struct {
+	cooldown time.Duration
+	mu       sync.Mutex
+	avoided  map[string]AvoidedAddress
+}
+
+func newAddressCooldowns(cooldown time.Duration) *addressCooldowns {
+	return &addressCooldowns{
+		cooldown: cooldown,
+		avoided:  make(map[string]AvoidedAddress),
+	}
+}
+
+// avoid skips addr for the cooldown period. It returns when addr stops being skipped, or false if skipping is
+// disabled.
+func (c *addressCooldowns) avoid(addr string, err error) (time.Time, bool) {
+	if c.cooldown <= 0 {
+		return time.Time{}, false
+	}
+	until := time.Now().Add(c.cooldown)
+	c.mu.Lock()
+	c.avoided[addr] = AvoidedAddress{Address: addr, Until: until, Err: err}
+	c.mu.Unlock()
+	return until, true
+}
+
+func (c *addressCooldowns) clear(addr string) {
+	c.mu.Lock()
+	delete(c.avoided, addr)
+	c.mu.Unlock()
+}
+
+// order moves the addresses that are skipped to the end, those whose cooldown expires first going first. The other
+// addresses keep their order. It also returns the number of skipped addresses.
+func (c *addressCooldowns) order(addrs []string) ([]string, int) {
+	now := time.Now()
+	ordered := make([]string, 0, len(addrs))
+	var avoided []AvoidedAddress
+
+	c.mu.Lock()
+	for _, addr := range addrs {
+		if a, ok := c.avoided[addr]; ok && now.Before(a.Until) {
+			avoided = append(avoided, a)
+		} else {
+			ordered = append(ordered, addr)
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(avoided, func(i, j int) bool {
+		return avoided[i].Until.Before(avoided[j].Until)
+	})
+	for _, a := range avoided {
+		ordered = append(ordered, a.Address)
+	}
+	return ordered, len(avoided)
+}
+
+// list returns the addresses that are currently skipped, dropping those whose cooldown has expired.
+func (c *addressCooldowns) list() []AvoidedAddress {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	avoided := make([]AvoidedAddress, 0, len(c.avoided))
+	for addr, a := range c.avoided {
+		if !now.Before(a.Until) {
+			delete(c.avoided, addr)
+			continue
+		}
+		avoided = append(avoided, a)
+	}
+	sort.Slice(avoided, func(i, j int) bool {
+		return avoided[i].Address < avoided[j].Address
+	})
+	return avoided
+}
@@ -0,0 +1,249 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArrangeAddrs(t *testing.T) {
+	addrs := []string{"10.0.0.1:29042", "10.0.0.2:29042", "[2001:db8::1]:29042", "[2001:db8::2]:29042", "ingress.local:29042"}
+	for _, tc := range []struct {
+		family AddressFamily
+		addrs  []string
+		want   []string
+	}{
+		{AddressFamilyAny, addrs, []string{"10.0.0.1:29042", "[2001:db8::1]:29042", "10.0.0.2:29042", "[2001:db8::2]:29042", "ingress.local:29042"}},
+		{AddressFamilyAny, []string{"[2001:db8::1]:29042", "10.0.0.1:29042"}, []string{"[2001:db8::1]:29042", "10.0.0.1:29042"}},
+		{AddressFamilyPreferIPv4, addrs, []string{"10.0.0.1:29042", "[2001:db8::1]:29042", "10.0.0.2:29042", "[2001:db8::2]:29042", "ingress.local:29042"}},
+		{AddressFamilyPreferIPv6, addrs, []string{"[2001:db8::1]:29042", "10.0.0.1:29042", "[2001:db8::2]:29042", "10.0.0.2:29042", "ingress.local:29042"}},
+		{AddressFamilyPreferIPv6, []string{"10.0.0.1:29042", "10.0.0.2:29042"}, []string{"10.0.0.1:29042", "10.0.0.2:29042"}},
+		{AddressFamilyIPv4Only, addrs, []string{"10.0.0.1:29042", "10.0.0.2:29042"}},
+		{AddressFamilyIPv6Only, addrs, []string{"[2001:db8::1]:29042", "[2001:db8::2]:29042"}},
+	} {
+		t.Run(fmt.Sprintf("%v %v", tc.family, tc.addrs), func(t *testing.T) {
+			got, err := arrangeAddrs(tc.addrs, tc.family)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+
+	_, err := arrangeAddrs([]string{"10.0.0.1:29042"}, AddressFamilyIPv6Only)
+	require.Error(t, err)
+}
+
+func TestAddressCooldownsOrder(t *testing.T) {
+	c := newAddressCooldowns(time.Minute)
+	_, ok := c.avoid("a:1", errors.New("a failed"))
+	require.True(t, ok)
+	_, ok = c.avoid("c:1", errors.New("c failed"))
+	require.True(t, ok)
+	// Expired, so it's tried in its place again
+	c.avoided["d:1"] = AvoidedAddress{Address: "d:1", Until: time.Now().Add(-time.Second)}
+
+	ordered, avoided := c.order([]string{"a:1", "b:1", "c:1", "d:1"})
+	require.Equal(t, []string{"b:1", "d:1", "a:1", "c:1"}, ordered)
+	require.Equal(t, 2, avoided)
+
+	c.clear("a:1")
+	ordered, avoided = c.order([]string{"a:1", "b:1", "c:1", "d:1"})
+	require.Equal(t, []string{"a:1", "b:1", "d:1", "c:1"}, ordered)
+	require.Equal(t, 1, avoided)
+
+	list := c.list()
+	require.Len(t, list, 1)
+	require.Equal(t, "c:1", list[0].Address)
+
+	_, ok = newAddressCooldowns(0).avoid("a:1", errors.New("a failed"))
+	require.False(t, ok)
+}
+
+// fakeIngress answers dials with an in-memory connection, or with the error configured for the address. Addresses
+// configured to hang block until the dial is canceled.
+type fakeIngress struct {
+	mu     sync.Mutex
+	errs   map[string]error
+	hang   map[string]bool
+	dialed []string
+	closed map[string]bool
+}
+
+func newFakeIngress() *fakeIngress {
+	return &fakeIngress{errs: make(map[string]error), hang: make(map[string]bool), closed: make(map[string]bool)}
+}
+
+func (f *fakeIngress) dialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	f.mu.Lock()
+	f.dialed = append(f.dialed, addr)
+	err, hang := f.errs[addr], f.hang[addr]
+	f.mu.Unlock()
+	if hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	client, server := net.Pipe()
+	_ = server.Close()
+	return &trackedConn{Conn: client, addr: addr, ingress: f}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	addr    string
+	ingress *fakeIngress
+}
+
+func (c *trackedConn) Close() error {
+	c.ingress.mu.Lock()
+	c.ingress.closed[c.addr] = true
+	c.ingress.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func newRaceDialer(t *testing.T, dial dialContextFunc, delay time.Duration) *dialer {
+	return newTestDialer(t, unreachableBundle(t),
+		WithDialContext(dial),
+		WithConnectionAttemptDelay(delay),
+		WithAddressCooldown(time.Minute))
+}
+
+func TestRaceConnect(t *testing.T) {
+	ingress := newFakeIngress()
+	ingress.hang["a:1"] = true
+	ingress.errs["b:1"] = syscall.ECONNREFUSED
+	d := newRaceDialer(t, ingress.dialContext, 10*time.Millisecond)
+
+	conn, addr, failed, err := d.raceConnect(context.Background(), []string{"a:1", "b:1", "c:1"}, 0, "host")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "c:1", addr)
+	require.Equal(t, map[string]bool{"b:1": true}, failed)
+
+	// The refused address is avoided, the one that was still connecting when the race was won isn't
+	avoided := d.AvoidedAddresses()
+	require.Len(t, avoided, 1)
+	require.Equal(t, "b:1", avoided[0].Address)
+	require.ErrorIs(t, avoided[0].Err, syscall.ECONNREFUSED)
+}
+
+func TestRaceConnectSequential(t *testing.T) {
+	ingress := newFakeIngress()
+	ingress.errs["a:1"] = syscall.ECONNREFUSED
+	d := newRaceDialer(t, ingress.dialContext, 0)
+
+	conn, addr, _, err := d.raceConnect(context.Background(), []string{"a:1", "b:1", "c:1"}, 0, "host")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "b:1", addr)
+	require.Equal(t, []string{"a:1", "b:1"}, ingress.dialed)
+}
+
+func TestRaceConnectAllFail(t *testing.T) {
+	ingress := newFakeIngress()
+	ingress.errs["a:1"] = syscall.ECONNREFUSED
+	ingress.errs["b:1"] = syscall.EHOSTUNREACH
+	d := newRaceDialer(t, ingress.dialContext, time.Millisecond)
+
+	_, _, failed, err := d.raceConnect(context.Background(), []string{"a:1", "b:1"}, 0, "host")
+	require.Error(t, err)
+	require.Equal(t, map[string]bool{"a:1": true, "b:1": true}, failed)
+	require.Len(t, d.AvoidedAddresses(), 2)
+}
+
+func TestRaceConnectClosesLosers(t *testing.T) {
+	ingress := newFakeIngress()
+	release := make(chan struct{})
+	d := newRaceDialer(t, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "a:1" {
+			// Let b:1 win, then connect a:1 too late
+			<-release
+		}
+		return ingress.dialContext(context.Background(), network, addr)
+	}, time.Millisecond)
+
+	conn, addr, _, err := d.raceConnect(context.Background(), []string{"a:1", "b:1"}, 0, "host")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "b:1", addr)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		ingress.mu.Lock()
+		defer ingress.mu.Unlock()
+		return ingress.closed["a:1"] && !ingress.closed["b:1"]
+	}, time.Second, time.Millisecond)
+}
+
+func TestRaceAddrsHandshakeFallback(t *testing.T) {
+	ca := newTestCA(t)
+	server := startTestServer(t, ca, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	// Accepts connections but drops them during the handshake, like an SNI proxy that doesn't know the node
+	dropping, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer dropping.Close()
+	go func() {
+		for {
+			conn, err := dropping.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	d := newRaceDialer(t, (&net.Dialer{}).DialContext, 0)
+	d.bundle.Store(serverBundle(t, ca, server))
+
+	serverAddr := server.Listener.Addr().String()
+	conn, addr, err := d.raceAddrs(context.Background(), "ingress:29042", []string{dropping.Addr().String(), serverAddr}, 0, "host")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, serverAddr, addr)
+	// The dropped handshake concerns the node, not the address
+	require.Empty(t, d.AvoidedAddresses())
+}
+
+func TestRemainingAddrs(t *testing.T) {
+	remaining, avoided := remainingAddrs([]string{"a:1", "b:1", "c:1", "d:1"}, 2, map[string]bool{"a:1": true, "c:1": true})
+	require.Equal(t, []string{"b:1", "d:1"}, remaining)
+	require.Equal(t, 1, avoided)
+}
+
+func TestIsAddressHandshakeError(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	require.True(t, isAddressHandshakeError(&handshakeError{hostId: "host", addr: "a:1", err: timeout}))
+	require.True(t, isAddressHandshakeError(&handshakeError{hostId: "host", addr: "a:1", err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}}))
+
+	alert := &net.OpError{Op: "remote error", Err: errors.New("tls: unrecognized name")}
+	require.False(t, isAddressHandshakeError(&handshakeError{hostId: "host", addr: "a:1", err: alert}))
+	require.False(t, isAddressHandshakeError(&handshakeError{hostId: "host", addr: "a:1", err: io.EOF}))
+	require.False(t, isAddressHandshakeError(&handshakeError{hostId: "host", addr: "a:1", err: syscall.ECONNRESET}))
+}
@@ -1,3 +1,9 @@
+//go:build integration
+
+// Integration tests against a live Astra database. Run them with:
+//
+//	go test -tags integration -bundle <path> -token <token> -username <username> -password <password> .
+
 package gocqlastra
 
 import (
@@ -157,3 +163,39 @@ func TestNewClusterFromURLWithLogger(t *testing.T) {
 	require.Nil(t, err)
 	coreTest(t, c)
 }
+
+func TestDialerMetadata(t *testing.T) {
+	d, err := NewDialerFromBundle(*flagBundle, 30*time.Second)
+	require.Nil(t, err)
+	metadata, err := d.Metadata(context.Background())
+	require.Nil(t, err)
+	require.NotEmpty(t, metadata.Region)
+	require.NotEmpty(t, metadata.LocalDc)
+	require.NotEmpty(t, metadata.SniProxyAddress)
+	require.NotEmpty(t, metadata.ContactPoints)
+}
+
+func TestNewClusterFromBundleWithLocalDCAwareRouting(t *testing.T) {
+	c, err := NewClusterFromBundle(*flagBundle, *flagUsername, *flagPassword, 30*time.Second, WithLocalDCAwareRouting())
+	require.Nil(t, err)
+	require.Equal(t, gocql.LocalQuorum, c.Consistency)
+	coreTest(t, c)
+}
+
+func TestNewClusterFromBundleBytes(t *testing.T) {
+	data, err := os.ReadFile(*flagBundle)
+	require.Nil(t, err)
+	c, err := NewClusterFromBundleBytes(data, *flagUsername, *flagPassword, 30*time.Second)
+	require.Nil(t, err)
+	coreTest(t, c)
+}
+
+func TestNewDialerFromBundleReader(t *testing.T) {
+	f, err := os.Open(*flagBundle)
+	require.Nil(t, err)
+	defer f.Close()
+	d, err := NewDialerFromBundleReader(f, 30*time.Second)
+	require.Nil(t, err)
+	c := NewCluster(d, *flagUsername, *flagPassword)
+	coreTest(t, c)
+}
@@ -0,0 +1,328 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+	"github.com/datastax/cql-proxy/astra"
+)
+
+// metadataRefreshRetryInterval bounds how often a failed metadata refresh is retried while
+// previously resolved metadata is still being served.
+const metadataRefreshRetryInterval = 10 * time.Second
+
+// metadataCall is a metadata fetch that's in flight. Concurrent callers that need metadata share the same call
+// instead of each issuing their own request.
+type metadataCall struct {
+	done     chan struct{}
+	metadata *astraMetadata
+	err      error
+}
+
+// resolveMetadata returns the metadata for the database. Cached metadata is returned
+// without blocking, even when it's expired, in which case a refresh is started in the background. Only the very
+// first resolution waits on the network, and it gives up waiting when ctx is done without cancelling the shared
+// fetch.
+func (d *dialer) resolveMetadata(ctx context.Context) (*astraMetadata, error) {
+	d.mu.Lock()
+	if metadata := d.metadata; metadata != nil {
+		if (d.metadataTTL > 0 || metadata.degraded) && !time.Now().Before(d.metadataExpiry) {
+			d.startMetadataCallLocked()
+		}
+		d.mu.Unlock()
+		return metadata, nil
+	}
+	call := d.startMetadataCallLocked()
+	d.mu.Unlock()
+	return call.wait(ctx)
+}
+
+// refreshMetadata fetches the metadata again, even if it hasn't expired, and waits for the fetch to complete. When
+// the fetch fails the previously resolved metadata keeps being used.
+func (d *dialer) refreshMetadata(ctx context.Context) (*astraMetadata, error) {
+	d.mu.Lock()
+	call := d.startMetadataCallLocked()
+	d.mu.Unlock()
+	return call.wait(ctx)
+}
+
+// wait waits for the fetch to complete, or for ctx to be done. The fetch isn't cancelled in the latter case.
+func (c *metadataCall) wait(ctx context.Context) (*astraMetadata, error) {
+	select {
+	case <-c.done:
+		return c.metadata, c.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("unable to resolve Astra metadata: %w", ctx.Err())
+	}
+}
+
+// startMetadataCallLocked returns the metadata fetch that's in flight, starting a new one if there is none.
+// d.mu must be held.
+func (d *dialer) startMetadataCallLocked() *metadataCall {
+	if d.metadataCall != nil {
+		return d.metadataCall
+	}
+	call := &metadataCall{done: make(chan struct{})}
+	d.metadataCall = call
+	go d.runMetadataCall(call)
+	return call
+}
+
+func (d *dialer) runMetadataCall(call *metadataCall) {
+	// The fetch is shared by every waiting caller so it must not be tied to any single caller's context.
+	loaded := d.bundle.Load()
+	metadata, err := d.fetchMetadata(context.Background(), loaded.Bundle)
+
+	var snapshot *astraMetadata
+	var snapshotSavedAt time.Time
+	if err != nil {
+		d.mu.Lock()
+		resolved := d.metadata != nil
+		d.mu.Unlock()
+		if !resolved {
+			snapshot, snapshotSavedAt = d.readMetadataSnapshot()
+		}
+	}
+
+	d.mu.Lock()
+	d.metadataCall = nil
+	if d.bundle.Load() != loaded && d.metadata != nil {
+		// The bundle was reloaded during the fetch, along with metadata resolved through the new bundle
+		d.logger.Debug("Secure connect bundle was reloaded while resolving Astra metadata, using the reloaded metadata.",
+			gocql.NewLogFieldString("version", loaded.Version))
+		metadata = d.metadata
+		d.mu.Unlock()
+		call.metadata, call.err = metadata, nil
+		close(call.done)
+		return
+	}
+	now := time.Now()
+	previous := d.metadata
+	retryInterval := metadataRefreshRetryInterval
+	if d.metadataTTL > 0 && d.metadataTTL < retryInterval {
+		retryInterval = d.metadataTTL
+	}
+	if err != nil {
+		if d.metadata != nil {
+			d.metadataExpiry = now.Add(retryInterval)
+			d.logger.Warning("Unable to refresh Astra metadata, using previously resolved metadata.",
+				gocql.NewLogFieldString("sni_proxy_addr", d.metadata.ContactInfo.SniProxyAddress),
+				gocql.NewLogFieldString("contact_points", strings.Join(d.metadata.ContactInfo.ContactPoints, ",")),
+				gocql.NewLogFieldBool("degraded", d.metadata.degraded),
+				gocql.NewLogFieldString("retry_in", retryInterval.String()),
+				gocql.NewLogFieldError("error", err))
+		} else if snapshot != nil {
+			d.useMetadataSnapshotLocked(snapshot, snapshotSavedAt, err)
+			d.metadataExpiry = now.Add(retryInterval)
+			metadata, err = snapshot, nil
+		}
+	} else {
+		d.metadata = metadata
+		d.metadataExpiry = now.Add(d.metadataTTL)
+		d.logger.Debug("Successfully resolved Astra metadata.",
+			gocql.NewLogFieldString("sni_proxy_addr", metadata.ContactInfo.SniProxyAddress),
+			gocql.NewLogFieldString("contact_points", strings.Join(metadata.ContactInfo.ContactPoints, ",")))
+		if previous != nil && previous.degraded {
+			d.logger.Info("Resolved Astra metadata from the metadata service, no longer using the persisted snapshot.")
+		}
+	}
+	degraded := d.metadata != nil && d.metadata.degraded
+	d.mu.Unlock()
+
+	if err == nil && !metadata.degraded {
+		d.saveMetadataSnapshot(metadata, previous)
+	}
+	if degraded {
+		d.scheduleDegradedRefresh(retryInterval)
+	}
+
+	call.metadata, call.err = metadata, err
+	close(call.done)
+}
+
+// fetchMetadata retrieves the metadata from the Astra metadata service of bundle, retrying failed requests according to
+// the dialer's metadata retry policy. Each attempt is bounded by the dialer's timeout.
+func (d *dialer) fetchMetadata(ctx context.Context, bundle *astra.Bundle) (*astraMetadata, error) {
+	policy := d.metadataRetryPolicy
+	maxAttempts := policy.maxAttempts()
+	for attempt := 1; ; attempt++ {
+		d.logger.Debug("Requesting Astra metadata.",
+			gocql.NewLogFieldInt("attempt", attempt),
+			gocql.NewLogFieldInt("max_attempts", maxAttempts))
+
+		metadata, retryable, err := d.fetchMetadataOnce(ctx, bundle)
+		if err == nil {
+			return metadata, nil
+		}
+		if !retryable || attempt >= maxAttempts {
+			d.logger.Warning("Astra metadata request failed.",
+				gocql.NewLogFieldInt("attempt", attempt),
+				gocql.NewLogFieldInt("max_attempts", maxAttempts),
+				gocql.NewLogFieldBool("retryable", retryable),
+				gocql.NewLogFieldError("error", err))
+			return nil, err
+		}
+
+		backoff := policy.backoff(attempt)
+		d.logger.Warning("Astra metadata request failed, retrying.",
+			gocql.NewLogFieldInt("attempt", attempt),
+			gocql.NewLogFieldInt("max_attempts", maxAttempts),
+			gocql.NewLogFieldString("backoff", backoff.String()),
+			gocql.NewLogFieldError("error", err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// fetchMetadataOnce makes a single request to the Astra metadata service of bundle. It also reports whether a failed
+// request can be retried according to the dialer's metadata retry policy.
+func (d *dialer) fetchMetadataOnce(ctx context.Context, bundle *astra.Bundle) (*astraMetadata, bool, error) {
+	var metadata *astraMetadata
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	transport := &http.Transport{
+		Proxy:           d.proxy,
+		DialContext:     d.dialContext,
+		TLSClientConfig: d.metadataTLSConfig(bundle),
+	}
+	defer transport.CloseIdleConnections()
+	httpsClient := &http.Client{Transport: transport}
+
+	url := fmt.Sprintf("https://%s:%d/metadata", bundle.Host, bundle.Port)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, err := httpsClient.Do(req)
+	if err != nil {
+		d.logger.Debug("Unable to retrieve Astra metadata.",
+			gocql.NewLogFieldString("url", url),
+			gocql.NewLogFieldError("error", err))
+		return nil, d.metadataRetryPolicy.isRetryableError(err), fmt.Errorf("unable to get Astra metadata from %s: %w", url, err)
+	}
+	defer response.Body.Close()
+
+	body, err := readAllWithTimeout(response.Body, ctx)
+	if err != nil {
+		d.logger.Debug("Unable to retrieve Astra metadata response body.",
+			gocql.NewLogFieldInt("status_code", response.StatusCode),
+			gocql.NewLogFieldString("url", url),
+			gocql.NewLogFieldError("error", err))
+		return nil, d.metadataRetryPolicy.isRetryableError(err), fmt.Errorf("unable to read Astra metadata response body from %s: %w, http code: %v", url, err, response.StatusCode)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		d.logger.Debug("Unexpected Astra metadata response status.",
+			gocql.NewLogFieldInt("status_code", response.StatusCode),
+			gocql.NewLogFieldString("response_body", string(body)),
+			gocql.NewLogFieldString("url", url))
+		return nil, d.metadataRetryPolicy.isRetryableStatusCode(response.StatusCode), fmt.Errorf("unexpected Astra metadata response from %s, received body: %v, http code: %v", url, string(body), response.StatusCode)
+	}
+
+	err = json.Unmarshal(body, &metadata)
+	if err != nil {
+		d.logger.Debug("Unable to decode Astra metadata response body.",
+			gocql.NewLogFieldInt("status_code", response.StatusCode),
+			gocql.NewLogFieldString("response_body", string(body)),
+			gocql.NewLogFieldString("url", url),
+			gocql.NewLogFieldError("error", err))
+		return nil, false, fmt.Errorf("unable to decode Astra metadata response body from %s: %w, received body: %v, http code: %v", url, err, string(body), response.StatusCode)
+	}
+
+	d.logger.Debug("Successfully retrieved and decoded Astra metadata.",
+		gocql.NewLogFieldInt("status_code", response.StatusCode),
+		gocql.NewLogFieldString("response_body", string(body)),
+		gocql.NewLogFieldString("url", url))
+
+	if metadata == nil || metadata.ContactInfo.SniProxyAddress == "" || len(metadata.ContactInfo.ContactPoints) == 0 {
+		return nil, false, fmt.Errorf("incomplete Astra metadata response body from %s, received body: %v, http code: %v", url, string(body), response.StatusCode)
+	}
+
+	return metadata, false, nil
+}
+
+// metadataTLSConfig returns the TLS configuration to reach the Astra metadata service of bundle, which also checks
+// the dialer's SPKI pins and verification callback and is restricted to its TLS policy.
+func (d *dialer) metadataTLSConfig(bundle *astra.Bundle) *tls.Config {
+	tlsConfig := bundle.TLSConfig.Clone()
+	d.tlsPolicy.apply(tlsConfig)
+	tlsConfig.KeyLogWriter = d.keyLogWriter
+	if verify := d.verifyChains(""); verify != nil {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verify(cs.VerifiedChains)
+		}
+	}
+	return tlsConfig
+}
+
+// Metadata is the information the Astra metadata service reports about a database.
+type Metadata struct {
+	// Version is the version of the metadata format.
+	Version int
+	// Region is the cloud region of the database the metadata was retrieved from.
+	Region string
+	// LocalDc is the name of the Cassandra datacenter that's local to Region.
+	LocalDc string
+	// SniProxyAddress is the host and port of the SNI proxy used to reach the database's nodes.
+	SniProxyAddress string
+	// ContactPoints are the host IDs of the nodes used to bootstrap a session.
+	ContactPoints []string
+	// Degraded is true when the metadata service couldn't be reached and the metadata comes from the snapshot
+	// persisted by WithMetadataSnapshot. The metadata service keeps being retried in the background.
+	Degraded bool
+}
+
+type contactInfo struct {
+	TypeName        string   `json:"type"`
+	LocalDc         string   `json:"local_dc"`
+	SniProxyAddress string   `json:"sni_proxy_address"`
+	ContactPoints   []string `json:"contact_points"`
+}
+
+type astraMetadata struct {
+	Version     int         `json:"version"`
+	Region      string      `json:"region"`
+	ContactInfo contactInfo `json:"contact_info"`
+
+	degraded bool // Loaded from the persisted snapshot instead of the metadata service
+}
+
+func (m *astraMetadata) public() *Metadata {
+	return &Metadata{
+		Version:         m.Version,
+		Region:          m.Region,
+		LocalDc:         m.ContactInfo.LocalDc,
+		SniProxyAddress: m.ContactInfo.SniProxyAddress,
+		ContactPoints:   append([]string(nil), m.ContactInfo.ContactPoints...),
+		Degraded:        m.degraded,
+	}
+}
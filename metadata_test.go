@@ -0,0 +1,228 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMetadataService is a metadata service whose answers can be delayed or made to fail.
+type fakeMetadataService struct {
+	requests atomic.Int32
+	mu       sync.Mutex
+	release  chan struct{} // Requests wait for it to be closed, when it's set
+	fail     bool
+	region   string
+}
+
+func startMetadataService(t *testing.T, ca *testCA) (*fakeMetadataService, *LoadedBundle) {
+	t.Helper()
+	s := &fakeMetadataService{region: "us-east1"}
+	server := startTestServer(t, ca, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s.requests.Add(1)
+		s.mu.Lock()
+		release, fail, region := s.release, s.fail, s.region
+		s.mu.Unlock()
+		if release != nil {
+			<-release
+		}
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"version":1,"region":%q,"contact_info":{"sni_proxy_address":"ingress:29042","contact_points":["a"]}}`, region)
+	}))
+	return s, serverBundle(t, ca, server)
+}
+
+// hold makes the following requests wait until the returned function is called.
+func (s *fakeMetadataService) hold() func() {
+	release := make(chan struct{})
+	s.mu.Lock()
+	s.release = release
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		s.release = nil
+		s.mu.Unlock()
+		close(release)
+	}
+}
+
+func (s *fakeMetadataService) setFailing(fail bool) {
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
+
+// waitMetadataCall waits for the metadata fetch in flight, if any, to complete.
+func waitMetadataCall(t *testing.T, d *dialer) {
+	t.Helper()
+	d.mu.Lock()
+	call := d.metadataCall
+	d.mu.Unlock()
+	if call != nil {
+		_, _ = call.wait(context.Background())
+	}
+}
+
+func TestResolveMetadataSharedFetch(t *testing.T) {
+	service, loaded := startMetadataService(t, newTestCA(t))
+	d := newTestDialer(t, loaded)
+	release := service.hold()
+
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			metadata, err := d.resolveMetadata(context.Background())
+			if err == nil && metadata.Region != "us-east1" {
+				err = fmt.Errorf("unexpected region %v", metadata.Region)
+			}
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool { return service.requests.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond) // Let every caller join the fetch
+	release()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(1), service.requests.Load())
+}
+
+func TestResolveMetadataCallerGivesUp(t *testing.T) {
+	service, loaded := startMetadataService(t, newTestCA(t))
+	d := newTestDialer(t, loaded)
+	release := service.hold()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.resolveMetadata(ctx)
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return service.requests.Load() == 1 }, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("resolveMetadata didn't return when its context was cancelled")
+	}
+
+	// The shared fetch went on
+	release()
+	waitMetadataCall(t, d)
+	metadata, err := d.resolveMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "us-east1", metadata.Region)
+	require.Equal(t, int32(1), service.requests.Load())
+}
+
+func TestResolveMetadataCachedWithoutWaiting(t *testing.T) {
+	service, loaded := startMetadataService(t, newTestCA(t))
+	d := newTestDialer(t, loaded, WithMetadataTTL(time.Minute))
+	first, err := d.resolveMetadata(context.Background())
+	require.NoError(t, err)
+
+	// Not expired: no request
+	cached, err := d.resolveMetadata(context.Background())
+	require.NoError(t, err)
+	require.Same(t, first, cached)
+	require.Equal(t, int32(1), service.requests.Load())
+
+	// Expired: returned without waiting for the refresh
+	release := service.hold()
+	defer release()
+	d.mu.Lock()
+	d.metadataExpiry = time.Now()
+	d.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cached, err = d.resolveMetadata(ctx)
+	require.NoError(t, err)
+	require.Same(t, first, cached)
+	require.Eventually(t, func() bool { return service.requests.Load() == 2 }, time.Second, time.Millisecond)
+}
+
+func TestMetadataTTLRefreshFailure(t *testing.T) {
+	service, loaded := startMetadataService(t, newTestCA(t))
+	const ttl = 200 * time.Millisecond
+	d := newTestDialer(t, loaded, WithMetadataTTL(ttl))
+	first, err := d.resolveMetadata(context.Background())
+	require.NoError(t, err)
+
+	service.setFailing(true)
+	time.Sleep(ttl)
+	metadata, err := d.resolveMetadata(context.Background())
+	require.NoError(t, err)
+	require.Same(t, first, metadata)
+	waitMetadataCall(t, d)
+	require.Equal(t, int32(2), service.requests.Load())
+
+	// The expired metadata keeps being served, and the refresh is retried after the TTL since it's below
+	// metadataRefreshRetryInterval
+	d.mu.Lock()
+	retryIn := time.Until(d.metadataExpiry)
+	d.mu.Unlock()
+	require.InDelta(t, ttl, retryIn, float64(ttl/2))
+	metadata, err = d.resolveMetadata(context.Background())
+	require.NoError(t, err)
+	require.Same(t, first, metadata)
+	require.Equal(t, int32(2), service.requests.Load())
+
+	time.Sleep(retryIn)
+	metadata, err = d.resolveMetadata(context.Background())
+	require.NoError(t, err)
+	require.Same(t, first, metadata)
+	waitMetadataCall(t, d)
+	require.Equal(t, int32(3), service.requests.Load())
+}
+
+func TestMetadataRefreshRetryInterval(t *testing.T) {
+	service, loaded := startMetadataService(t, newTestCA(t))
+	d := newTestDialer(t, loaded, WithMetadataTTL(time.Hour))
+	_, err := d.resolveMetadata(context.Background())
+	require.NoError(t, err)
+
+	service.setFailing(true)
+	d.mu.Lock()
+	d.metadataExpiry = time.Now()
+	d.mu.Unlock()
+	_, err = d.resolveMetadata(context.Background())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return service.requests.Load() == 2 }, time.Second, time.Millisecond)
+	waitMetadataCall(t, d)
+
+	// Retried after metadataRefreshRetryInterval since it's below the TTL
+	d.mu.Lock()
+	retryIn := time.Until(d.metadataExpiry)
+	d.mu.Unlock()
+	require.InDelta(t, metadataRefreshRetryInterval, retryIn, float64(time.Second))
+}
@@ -0,0 +1,282 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DialerOption configures optional behavior of a dialer created by one of the NewDialer* functions.
+type DialerOption func(*dialer)
+
+// WithMetadataTTL sets how long Astra metadata (the SNI proxy address and contact points) is cached before it's
+// refreshed in the background. A TTL of zero or less, the default, caches the metadata for the lifetime of the dialer.
+//
+// When a refresh fails the previously resolved metadata keeps being used and a warning is logged, so an unreachable
+// metadata service doesn't break new connections.
+func WithMetadataTTL(ttl time.Duration) DialerOption {
+	return func(d *dialer) {
+		d.metadataTTL = ttl
+	}
+}
+
+// WithMetadataRetryPolicy sets how failed requests to the Astra metadata service are retried. DefaultRetryPolicy is
+// used when this option isn't provided.
+func WithMetadataRetryPolicy(policy RetryPolicy) DialerOption {
+	return func(d *dialer) {
+		d.metadataRetryPolicy = policy
+	}
+}
+
+// WithProxyFromEnvironment routes the Astra metadata request and the connections to the SNI proxy through the proxy
+// configured by the HTTPS_PROXY and NO_PROXY environment variables (or their lowercase versions). Connections to the
+// SNI proxy are tunnelled using HTTP CONNECT before the TLS handshake.
+func WithProxyFromEnvironment() DialerOption {
+	return func(d *dialer) {
+		d.proxy = http.ProxyFromEnvironment
+	}
+}
+
+// WithProxyURL routes the Astra metadata request and the connections to the SNI proxy through the HTTP proxy at
+// proxyURL. The URL's scheme is either "http" or "https" and it may contain credentials, which are sent using basic
+// authentication. Connections to the SNI proxy are tunnelled using HTTP CONNECT before the TLS handshake. Creating
+// the dialer fails for other schemes, use WithSOCKS5Proxy for a SOCKS5 proxy.
+func WithProxyURL(proxyURL *url.URL) DialerOption {
+	return func(d *dialer) {
+		d.proxy = http.ProxyURL(proxyURL)
+		d.proxyURL = proxyURL
+	}
+}
+
+// WithSOCKS5Proxy routes the Astra metadata request and the connections to the SNI proxy through the SOCKS5 proxy at
+// addr, for instance one opened with "ssh -D". Username/password authentication is used when either is non-empty.
+// The SOCKS5 proxy resolves the SNI proxy hostname. TLS is still negotiated end-to-end with Astra.
+func WithSOCKS5Proxy(addr, username, password string) DialerOption {
+	return func(d *dialer) {
+		d.socks5 = &socks5Proxy{
+			addr:     addr,
+			username: username,
+			password: password,
+		}
+	}
+}
+
+// WithDialContext replaces the function used to open every network connection made by the dialer: connections to the
+// SNI proxy, to the Astra metadata service, to the Astra DevOps API and to any configured proxy. It can be used to go
+// through a service mesh sidecar, to set socket options or to connect to in-memory pipes in tests. A zero net.Dialer is
+// used by default.
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) DialerOption {
+	return func(d *dialer) {
+		d.netDial = dial
+	}
+}
+
+// WithResolver sets the resolver used to look up the addresses of the SNI proxy hostname, for instance a
+// *net.Resolver using a specific DNS server or a StaticResolver. net.DefaultResolver is used by default.
+func WithResolver(resolver Resolver) DialerOption {
+	return func(d *dialer) {
+		d.customResolver = resolver
+	}
+}
+
+// WithDNSCacheTTL sets how long the addresses of the SNI proxy hostname are cached. A TTL of zero or less resolves the
+// hostname on every dial. DefaultDNSCacheTTL is used by default. Expired addresses keep being used when a lookup
+// fails.
+func WithDNSCacheTTL(ttl time.Duration) DialerOption {
+	return func(d *dialer) {
+		d.dnsCacheTTL = ttl
+	}
+}
+
+// WithAddressCooldown sets how long an SNI proxy address that failed to connect, or that doesn't complete TLS
+// handshakes, is skipped in favor of the other addresses of the SNI proxy hostname. Skipped addresses are still tried
+// when every other address fails. A handshake rejected because of the node, such as a host that's no longer part of
+// the database, doesn't put the address in cooldown. A cooldown of zero or less disables skipping.
+// DefaultAddressCooldown is used by default.
+func WithAddressCooldown(cooldown time.Duration) DialerOption {
+	return func(d *dialer) {
+		d.addrCooldown = cooldown
+	}
+}
+
+// WithConnectionAttemptDelay sets how long to wait before racing another address of the SNI proxy hostname against the
+// ones being dialed, as described by Happy Eyeballs (RFC 8305). This avoids waiting for the whole dial timeout when,
+// for instance, the IPv6 path is broken. A delay of zero or less dials the addresses one at a time.
+// DefaultConnectionAttemptDelay is used by default.
+func WithConnectionAttemptDelay(delay time.Duration) DialerOption {
+	return func(d *dialer) {
+		d.connectionAttemptDelay = delay
+	}
+}
+
+// WithAddressFamily sets which IP versions are used to reach the SNI proxy and which one is tried first.
+// AddressFamilyAny is used by default.
+func WithAddressFamily(family AddressFamily) DialerOption {
+	return func(d *dialer) {
+		d.addrFamily = family
+	}
+}
+
+// WithContactPointBackoff sets how long a contact point that failed to be dialed is skipped in favor of the other
+// contact points. The first failure skips it for base, and every consecutive failure doubles that time up to max.
+// DefaultContactPointBaseBackoff and DefaultContactPointMaxBackoff are used by default.
+func WithContactPointBackoff(base, max time.Duration) DialerOption {
+	return func(d *dialer) {
+		d.contactPointBaseBackoff = base
+		d.contactPointMaxBackoff = max
+	}
+}
+
+// WithUnknownHostThreshold sets the number of consecutive failed TLS handshakes with a node after which the Astra
+// metadata is refreshed and a contact point is dialed through the same SNI proxy. When that succeeds, DialHost returns
+// an UnknownHostError for the node. Each node is checked at most every 10 seconds. A threshold of zero or less
+// disables the detection. DefaultUnknownHostThreshold is used by default.
+func WithUnknownHostThreshold(threshold int) DialerOption {
+	return func(d *dialer) {
+		d.unknownHostThreshold = threshold
+	}
+}
+
+// WithBundleReload makes the dialer load its secure connect bundle again every interval, for instance to pick up
+// rotated certificates. It only applies to dialers created from a BundleSource, including a bundle file or the Astra
+// DevOps API. A bundle with a new version is validated, and must be able to reach the Astra metadata service,
+// before it's used for new connections; otherwise the current bundle is kept. Call Close to stop reloading.
+func WithBundleReload(interval time.Duration) DialerOption {
+	return func(d *dialer) {
+		d.bundleReloadInterval = interval
+	}
+}
+
+// WithCertificateExpiryWarnings sets how long before a certificate of the secure connect bundle expires warnings are
+// logged. Each threshold is logged once per certificate, and an error is logged once it has expired. Certificates are
+// checked when the dialer is created, when the bundle is reloaded and, at most once an hour, when dialing. No
+// background goroutine is started for it. Calling it without thresholds disables the warnings.
+// DefaultCertificateExpiryWarnings is used by default.
+func WithCertificateExpiryWarnings(thresholds ...time.Duration) DialerOption {
+	return func(d *dialer) {
+		d.certExpiryWarnings = thresholds
+	}
+}
+
+// WithRejectExpiredBundle makes creating the dialer fail with an ExpiredCertificateError when a certificate of the
+// secure connect bundle has expired or isn't valid yet. Reloaded bundles with such certificates are ignored.
+func WithRejectExpiredBundle() DialerOption {
+	return func(d *dialer) {
+		d.rejectExpiredBundle = true
+	}
+}
+
+// WithBundleCacheDir caches the secure connect bundle downloaded from the Astra DevOps API in dir. A cached bundle
+// whose certificates are still valid is used without waiting for the DevOps API, which is then queried in the
+// background to update the cache. It only applies to dialers created with NewDialerFromURL or
+// NewDialerFromURLWithLogger. See URLBundleSource.
+func WithBundleCacheDir(dir string) DialerOption {
+	return func(d *dialer) {
+		d.bundleCacheDir = dir
+	}
+}
+
+// peekDialerOptions returns the settings of opts, for those that are needed before the dialer is created, such as
+// the settings used to load its bundle.
+func peekDialerOptions(opts []DialerOption) *dialer {
+	d := &dialer{netDial: (&net.Dialer{}).DialContext}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// WithMetadataSnapshot persists the metadata resolved from the Astra metadata service to the file at path, which is
+// replaced atomically and readable only by the current user. When the metadata service can't be reached before any
+// metadata was resolved, for instance when the process starts during an outage, the snapshot is used instead: the
+// dialer reports Metadata.Degraded and keeps retrying the metadata service in the background. A snapshot saved for
+// another bundle endpoint is ignored, so path shouldn't be shared between dialers of different databases or regions.
+func WithMetadataSnapshot(path string) DialerOption {
+	return func(d *dialer) {
+		d.metadataSnapshotPath = path
+	}
+}
+
+// WithTLSSessionCacheSize sets how many TLS sessions are kept to resume connections to Astra nodes, which makes
+// reconnecting cheaper than a full handshake. Sessions are cached per node and SNI proxy, and the least recently used
+// ones are evicted first. A size of zero or less disables resumption. DefaultTLSSessionCacheSize is used by default.
+func WithTLSSessionCacheSize(size int) DialerOption {
+	return func(d *dialer) {
+		d.sessionCacheSize = size
+	}
+}
+
+// WithSPKIPins requires a certificate presented by Astra, either the leaf, an intermediate or the root of the
+// verified chain, to match one of pins. A pin is the base64 encoded SHA-256 hash of a certificate's
+// SubjectPublicKeyInfo, optionally prefixed by "sha256/", as returned by SPKIHash. Pins apply to connections to the
+// nodes and to the Astra metadata service. Creating the dialer fails if a pin is invalid.
+func WithSPKIPins(pins ...string) DialerOption {
+	return func(d *dialer) {
+		d.spkiPinValues = pins
+	}
+}
+
+// WithVerifyCertificate makes the dialer call verify to perform additional checks of the certificates presented by
+// Astra, after they were verified against the bundle's CA and the SPKI pins. Connections that resume a TLS session
+// aren't verified again, since the session was established by a verified handshake.
+func WithVerifyCertificate(verify VerifyCertificateFunc) DialerOption {
+	return func(d *dialer) {
+		d.verifyCertificate = verify
+	}
+}
+
+// WithTLSPolicy restricts the TLS versions, cipher suites and curves used to connect to the Astra metadata service
+// and to the nodes. Creating the dialer fails if the policy is inconsistent or, for a FIPS policy such as
+// FIPSTLSPolicy, if the policy or the bundle's certificates use algorithms that aren't FIPS-approved. A FIPS policy
+// also fails for a dialer created from an *astra.Bundle, such as with NewDialer, since the CA certificates of the
+// bundle can't be checked.
+func WithTLSPolicy(policy TLSPolicy) DialerOption {
+	return func(d *dialer) {
+		d.tlsPolicy = policy
+	}
+}
+
+// WithKeyLogWriter writes the TLS secrets of the connections to the Astra metadata service and to the nodes to w, in
+// the NSS key log format, so that captured traffic can be decrypted, for instance by Wireshark. It must only be used
+// for debugging since it compromises the security of the connections.
+func WithKeyLogWriter(w io.Writer) DialerOption {
+	return func(d *dialer) {
+		d.keyLogWriter = w
+	}
+}
+
+// WithKeyLogFromEnvironment writes the TLS secrets of the connections to the file named by the SSLKEYLOGFILE
+// environment variable, if it's set, like WithKeyLogWriter. The file is opened for appending when the dialer is
+// created and closed by Close.
+func WithKeyLogFromEnvironment() DialerOption {
+	return func(d *dialer) {
+		d.keyLogFromEnv = true
+	}
+}
+
+// WithTokenProvider sets the provider of the Astra application token. It's used instead of the static token to
+// download the bundle by NewDialerFromURL and NewDialerFromURLWithLogger, including when the bundle is reloaded. The
+// NewClusterFrom* functions given this option through WithDialerOptions authenticate connections with a
+// TokenAuthenticator using the provider, instead of the username and password.
+func WithTokenProvider(provider TokenProvider) DialerOption {
+	return func(d *dialer) {
+		d.tokenProvider = provider
+	}
+}
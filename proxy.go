@@ -0,0 +1,164 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ingressProxy returns the HTTP proxy used to reach the SNI proxy at sniAddr, or nil when it's dialed directly.
+func (d *dialer) ingressProxy(sniAddr string) (*url.URL, error) {
+	if d.proxy == nil {
+		return nil, nil
+	}
+	proxyURL, err := d.proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: sniAddr}})
+	if err != nil || proxyURL == nil {
+		return nil, err
+	}
+	if err = checkProxyURL(proxyURL); err != nil {
+		return nil, err
+	}
+	return proxyURL, nil
+}
+
+// checkProxyURL checks that proxyURL is an HTTP proxy, which can tunnel connections using HTTP CONNECT.
+func checkProxyURL(proxyURL *url.URL) error {
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q for proxy %v, expected http or https", proxyURL.Scheme, proxyURL.Redacted())
+	}
+	if proxyURL.Host == "" {
+		return fmt.Errorf("proxy %v has no host", proxyURL.Redacted())
+	}
+	return nil
+}
+
+// dialHTTPConnect opens a tunnel to addr through the HTTP proxy at proxyURL using the CONNECT method. Credentials
+// in the proxy URL are sent using basic authentication. The proxy resolves addr, so it may be a hostname that isn't
+// resolvable locally.
+func dialHTTPConnect(ctx context.Context, dial dialContextFunc, proxyURL *url.URL, addr string) (_ net.Conn, err error) {
+	conn, err := dial(ctx, "tcp", proxyAddr(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() {
+			_ = conn.SetDeadline(time.Time{})
+		}()
+	}
+	stop := closeOnDone(ctx, conn)
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+	}()
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused CONNECT to %v: %v", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// closeOnDone closes conn if ctx is done before the returned stop function is called. stop reports whether it was
+// called in time, in which case conn is left open.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func() bool) {
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return !<-closed
+	}
+}
+
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	port := "80"
+	if strings.EqualFold(proxyURL.Scheme, "https") {
+		port = "443"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// bufferedConn is a net.Conn whose first reads are served from data that was already buffered while reading the
+// proxy's response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
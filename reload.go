@@ -0,0 +1,135 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+	"github.com/datastax/cql-proxy/astra"
+)
+
+// startBundleReload starts reloading the bundle from source in the background, if the dialer is configured to.
+func (d *dialer) startBundleReload(source BundleSource, version string) {
+	if d.bundleReloadInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(d.bundleReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.closed:
+				return
+			case <-ticker.C:
+				version = d.reloadBundle(source, version)
+			}
+		}
+	}()
+}
+
+// reloadBundle loads the bundle from source and, if its version changed and it's valid, uses it for new
+// connections. It returns the version of the bundle in use.
+func (d *dialer) reloadBundle(source BundleSource, version string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	loaded, err := source.LoadBundle(ctx)
+	if err != nil {
+		d.logger.Warning("Unable to reload secure connect bundle, keeping the current one.",
+			gocql.NewLogFieldError("error", err))
+		return version
+	}
+	if loaded.Version == version {
+		return version
+	}
+
+	err = validateBundle(loaded.Bundle, time.Now())
+	if err == nil && d.rejectExpiredBundle {
+		err = checkCertificatesValid(bundleCertificates(loaded), time.Now())
+	}
+	if err == nil {
+		err = d.tlsPolicy.validateBundle(loaded)
+	}
+	if err != nil {
+		d.logger.Warning("Reloaded secure connect bundle is invalid, keeping the current one.",
+			gocql.NewLogFieldString("version", loaded.Version),
+			gocql.NewLogFieldError("error", err))
+		return version
+	}
+	metadata, _, err := d.fetchMetadataOnce(ctx, loaded.Bundle)
+	if err != nil {
+		d.logger.Warning("Reloaded secure connect bundle can't reach the Astra metadata service, keeping the current one.",
+			gocql.NewLogFieldString("version", loaded.Version),
+			gocql.NewLogFieldError("error", err))
+		return version
+	}
+
+	// Swapped together under d.mu so that a metadata fetch made with the previous bundle doesn't overwrite the
+	// metadata, see runMetadataCall.
+	d.mu.Lock()
+	d.bundle.Store(loaded)
+	previous := d.metadata
+	d.metadata = metadata
+	d.metadataExpiry = time.Now().Add(d.metadataTTL)
+	d.mu.Unlock()
+	d.saveMetadataSnapshot(metadata, previous)
+
+	d.logger.Info("Reloaded secure connect bundle.",
+		gocql.NewLogFieldString("previous_version", version),
+		gocql.NewLogFieldString("version", loaded.Version),
+		gocql.NewLogFieldString("expiry", loaded.Expiry.Format(time.RFC3339)))
+	d.checkCertificateExpiry()
+	return loaded.Version
+}
+
+// validateBundle checks that bundle has an endpoint and a client certificate that's valid at now.
+func validateBundle(bundle *astra.Bundle, now time.Time) error {
+	if bundle == nil || bundle.TLSConfig == nil {
+		return errors.New("bundle has no TLS configuration")
+	}
+	if bundle.Host == "" || bundle.Port <= 0 {
+		return fmt.Errorf("bundle has an invalid endpoint %s:%d", bundle.Host, bundle.Port)
+	}
+	if len(bundle.TLSConfig.Certificates) == 0 || len(bundle.TLSConfig.Certificates[0].Certificate) == 0 {
+		return errors.New("bundle has no client certificate")
+	}
+	leaf, err := x509.ParseCertificate(bundle.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		return fmt.Errorf("bundle has an invalid client certificate: %w", err)
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("bundle client certificate isn't valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("bundle client certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (d *dialer) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		if d.keyLogFile != nil {
+			err = d.keyLogFile.Close()
+		}
+	})
+	return err
+}
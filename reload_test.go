@@ -0,0 +1,64 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// loadedBundleSource always returns loaded.
+type loadedBundleSource struct {
+	loaded *LoadedBundle
+}
+
+func (s *loadedBundleSource) LoadBundle(_ context.Context) (*LoadedBundle, error) {
+	return s.loaded, nil
+}
+
+func TestReloadedMetadataNotOverwrittenByStaleFetch(t *testing.T) {
+	ca := newTestCA(t)
+	requested := make(chan struct{})
+	release := make(chan struct{})
+	stale := startTestServer(t, ca, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(requested)
+		<-release
+		_, _ = w.Write([]byte(`{"version":1,"region":"stale","contact_info":{"sni_proxy_address":"stale:29042","contact_points":["a"]}}`))
+	}))
+	reloaded := startTestServer(t, ca, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"version":1,"region":"reloaded","contact_info":{"sni_proxy_address":"reloaded:29042","contact_points":["b"]}}`))
+	}))
+
+	d := newTestDialer(t, serverBundle(t, ca, stale), WithMetadataTTL(time.Minute))
+	d.mu.Lock()
+	call := d.startMetadataCallLocked()
+	d.mu.Unlock()
+	<-requested
+
+	loaded := serverBundle(t, ca, reloaded)
+	require.Equal(t, loaded.Version, d.reloadBundle(&loadedBundleSource{loaded: loaded}, d.bundle.Load().Version))
+	close(release)
+
+	metadata, err := call.wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "reloaded", metadata.Region)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	require.Equal(t, "reloaded", d.metadata.Region)
+}
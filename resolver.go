@@ -0,0 +1,139 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+)
+
+// DefaultDNSCacheTTL is how long the addresses of the SNI proxy hostname are cached by default.
+const DefaultDNSCacheTTL = 30 * time.Second
+
+// Resolver looks up the addresses of a hostname. It's implemented by *net.Resolver and StaticResolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// StaticResolver is a Resolver that resolves hostnames from a fixed map of hostnames to addresses.
+type StaticResolver map[string][]string
+
+func (r StaticResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs := r[host]
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return append([]string(nil), addrs...), nil
+}
+
+// Sources of resolved addresses, reported in debug logs.
+const (
+	resolvedFromLiteral    = "ip_literal"
+	resolvedFromCache      = "cache"
+	resolvedFromResolver   = "resolver"
+	resolvedFromStaleCache = "stale_cache"
+)
+
+type resolvedHost struct {
+	addrs  []string
+	expiry time.Time
+}
+
+// cachingResolver caches the addresses returned by a Resolver. When a lookup fails, expired addresses are used
+// rather than failing the dial.
+type cachingResolver struct {
+	resolver Resolver
+	ttl      time.Duration
+	mu       sync.Mutex
+	hosts    map[string]resolvedHost
+}
+
+func newCachingResolver(resolver Resolver, ttl time.Duration) *cachingResolver {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &cachingResolver{
+		resolver: resolver,
+		ttl:      ttl,
+		hosts:    make(map[string]resolvedHost),
+	}
+}
+
+// lookupHost returns the addresses of host and where they came from.
+func (r *cachingResolver) lookupHost(ctx context.Context, host string) ([]string, string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, resolvedFromLiteral, nil
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	cached, ok := r.hosts[host]
+	r.mu.Unlock()
+	if ok && r.ttl > 0 && now.Before(cached.expiry) {
+		return cached.addrs, resolvedFromCache, nil
+	}
+
+	addrs, err := r.resolver.LookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		if ok && ctx.Err() == nil {
+			return cached.addrs, resolvedFromStaleCache, nil
+		}
+		return nil, "", err
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		r.hosts[host] = resolvedHost{addrs: addrs, expiry: now.Add(r.ttl)}
+		r.mu.Unlock()
+	}
+	return addrs, resolvedFromResolver, nil
+}
+
+// lookupHost resolves the host part of hostWithPort and returns its addresses, with the port, in random order.
+func (d *dialer) lookupHost(ctx context.Context, hostWithPort string) ([]string, error) {
+	host, port, err := net.SplitHostPort(hostWithPort)
+	if err != nil {
+		return nil, err
+	}
+	resolved, source, err := d.resolver.lookupHost(ctx, host)
+	if err != nil {
+		d.logger.Debug("Unable to resolve Astra SNI proxy hostname.",
+			gocql.NewLogFieldString("sni_proxy_hostname", host),
+			gocql.NewLogFieldError("error", err))
+		return nil, err
+	}
+	d.logger.Debug("Resolved Astra SNI proxy hostname.",
+		gocql.NewLogFieldString("sni_proxy_hostname", host),
+		gocql.NewLogFieldString("addrs", strings.Join(resolved, ",")),
+		gocql.NewLogFieldString("source", source))
+
+	addrs := make([]string, len(resolved))
+	for i, j := range rand.Perm(len(resolved)) {
+		addrs[i] = resolved[j]
+		if len(port) > 0 {
+			addrs[i] = net.JoinHostPort(resolved[j], port)
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,155 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver answers lookups with addrs, or err when it's set, and counts them.
+type fakeResolver struct {
+	addrs   []string
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, _ string) ([]string, error) {
+	r.lookups++
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.addrs, nil
+}
+
+// expireResolved makes the addresses of host cached by r expire.
+func expireResolved(r *cachingResolver, host string) {
+	r.mu.Lock()
+	cached := r.hosts[host]
+	cached.expiry = time.Now()
+	r.hosts[host] = cached
+	r.mu.Unlock()
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	resolver := &fakeResolver{addrs: []string{"10.0.0.1"}}
+	r := newCachingResolver(resolver, time.Minute)
+
+	addrs, source, err := r.lookupHost(context.Background(), "ingress")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, addrs)
+	require.Equal(t, resolvedFromResolver, source)
+
+	resolver.addrs = []string{"10.0.0.2"}
+	addrs, source, err = r.lookupHost(context.Background(), "ingress")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, addrs)
+	require.Equal(t, resolvedFromCache, source)
+	require.Equal(t, 1, resolver.lookups)
+
+	expireResolved(r, "ingress")
+	addrs, source, err = r.lookupHost(context.Background(), "ingress")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.2"}, addrs)
+	require.Equal(t, resolvedFromResolver, source)
+	require.Equal(t, 2, resolver.lookups)
+
+	// IP literals aren't looked up
+	addrs, source, err = r.lookupHost(context.Background(), "10.0.0.3")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.3"}, addrs)
+	require.Equal(t, resolvedFromLiteral, source)
+	require.Equal(t, 2, resolver.lookups)
+}
+
+func TestCachingResolverNoCache(t *testing.T) {
+	resolver := &fakeResolver{addrs: []string{"10.0.0.1"}}
+	r := newCachingResolver(resolver, 0)
+	for i := 0; i < 2; i++ {
+		_, source, err := r.lookupHost(context.Background(), "ingress")
+		require.NoError(t, err)
+		require.Equal(t, resolvedFromResolver, source)
+	}
+	require.Equal(t, 2, resolver.lookups)
+
+	resolver.err = errors.New("lookup failed")
+	_, _, err := r.lookupHost(context.Background(), "ingress")
+	require.ErrorIs(t, err, resolver.err)
+}
+
+func TestCachingResolverStaleCache(t *testing.T) {
+	resolver := &fakeResolver{addrs: []string{"10.0.0.1"}}
+	r := newCachingResolver(resolver, time.Minute)
+	_, _, err := r.lookupHost(context.Background(), "ingress")
+	require.NoError(t, err)
+
+	// The expired addresses are used when the lookup fails
+	expireResolved(r, "ingress")
+	resolver.err = errors.New("lookup failed")
+	addrs, source, err := r.lookupHost(context.Background(), "ingress")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, addrs)
+	require.Equal(t, resolvedFromStaleCache, source)
+
+	// Including when it returns no addresses
+	resolver.err, resolver.addrs = nil, nil
+	addrs, source, err = r.lookupHost(context.Background(), "ingress")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, addrs)
+	require.Equal(t, resolvedFromStaleCache, source)
+
+	// But not when the dial was cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = r.lookupHost(ctx, "ingress")
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Nor for a host that was never resolved
+	resolver.err = errors.New("lookup failed")
+	_, _, err = r.lookupHost(context.Background(), "other")
+	require.ErrorIs(t, err, resolver.err)
+}
+
+func TestStaticResolver(t *testing.T) {
+	resolver := StaticResolver{"ingress": {"10.0.0.1", "10.0.0.2"}}
+	addrs, err := resolver.LookupHost(context.Background(), "ingress")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addrs)
+
+	// The returned addresses are a copy
+	addrs[0] = "10.0.0.3"
+	addrs, err = resolver.LookupHost(context.Background(), "ingress")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addrs)
+
+	_, err = resolver.LookupHost(context.Background(), "other")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	require.True(t, dnsErr.IsNotFound)
+
+	// Used by the dialer, with the port of the SNI proxy
+	d := newTestDialer(t, unreachableBundle(t), WithResolver(resolver))
+	addrs, err = d.lookupHost(context.Background(), "ingress:29042")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"10.0.0.1:29042", "10.0.0.2:29042"}, addrs)
+}
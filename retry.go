@@ -0,0 +1,141 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how failed requests to the Astra metadata service are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one. Values less than 1 disable retries.
+	MaxAttempts int
+	// BaseBackoff is the delay before the first retry. It doubles after every failed retry.
+	BaseBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts.
+	MaxBackoff time.Duration
+	// Jitter is the fraction, between 0 and 1, of each backoff that's randomized to spread out retries from
+	// concurrent clients.
+	Jitter float64
+	// RetryableStatusCodes are the HTTP status codes that are retried.
+	RetryableStatusCodes []int
+	// IsRetryableError reports whether a network error is retried. IsRetryableNetworkError is used when nil.
+	IsRetryableError func(err error) bool
+}
+
+// DefaultRetryPolicy returns the retry policy used by dialers that aren't configured with WithMetadataRetryPolicy.
+// It makes up to three attempts and retries throttling, gateway and server-unavailable responses, as well as
+// transient network errors.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseBackoff: 200 * time.Millisecond,
+		MaxBackoff:  2 * time.Second,
+		Jitter:      0.2,
+		RetryableStatusCodes: []int{
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// IsRetryableNetworkError reports whether err looks like a transient network failure: a timeout, a refused or
+// reset connection, or a connection that was closed before a complete response was received. Certificate and
+// other TLS errors, including alerts sent by the server such as a rejected client certificate, and hostnames that
+// don't exist aren't retryable.
+func IsRetryableNetworkError(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "remote error" || opErr.Op == "local error") {
+		// TLS alerts, sent by the server or by crypto/tls itself
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound && (dnsErr.IsTimeout || dnsErr.IsTemporary)
+	}
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns the delay to wait after the given failed attempt, starting at 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || backoff < p.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if p.Jitter > 0 && backoff > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		backoff -= time.Duration(rand.Float64() * jitter * float64(backoff))
+	}
+	return backoff
+}
+
+func (p RetryPolicy) isRetryableStatusCode(code int) bool {
+	for _, c := range p.RetryableStatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RetryPolicy) isRetryableError(err error) bool {
+	if p.IsRetryableError != nil {
+		return p.IsRetryableError(err)
+	}
+	return IsRetryableNetworkError(err)
+}
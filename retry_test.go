@@ -0,0 +1,96 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryableNetworkError(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "deadline exceeded", err: context.DeadlineExceeded, retryable: true},
+		{name: "canceled", err: context.Canceled, retryable: false},
+		{name: "unexpected EOF", err: &url.Error{Op: "Get", URL: "https://astra", Err: io.ErrUnexpectedEOF}, retryable: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, retryable: true},
+		{name: "connection reset", err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, retryable: true},
+		{name: "write failure", err: &net.OpError{Op: "write", Net: "tcp", Err: errors.New("broken pipe")}, retryable: true},
+		{name: "TLS remote alert", err: &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}, retryable: false},
+		{name: "TLS local alert", err: &net.OpError{Op: "local error", Err: errors.New("tls: unexpected message")}, retryable: false},
+		{name: "no such host", err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "astra", IsNotFound: true}}, retryable: false},
+		{name: "DNS timeout", err: &net.DNSError{Err: "i/o timeout", Name: "astra", IsTimeout: true}, retryable: true},
+		{name: "unknown authority", err: &url.Error{Op: "Get", URL: "https://astra", Err: x509.UnknownAuthorityError{}}, retryable: false},
+		{name: "other", err: errors.New("boom"), retryable: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.retryable, IsRetryableNetworkError(tc.err))
+			require.Equal(t, tc.retryable, IsRetryableNetworkError(fmt.Errorf("wrapped: %w", tc.err)))
+		})
+	}
+}
+
+func TestIsRetryableNetworkErrorRejectedClientCertificate(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	_, err := client.Get(srv.URL)
+	require.Error(t, err)
+	require.False(t, IsRetryableNetworkError(err), "error: %v", err)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	require.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	require.Equal(t, 200*time.Millisecond, policy.backoff(2))
+	require.Equal(t, 400*time.Millisecond, policy.backoff(3))
+	require.Equal(t, time.Second, policy.backoff(5))
+	require.Equal(t, time.Second, policy.backoff(100))
+
+	unbounded := RetryPolicy{BaseBackoff: 100 * time.Millisecond}
+	require.Equal(t, 800*time.Millisecond, unbounded.backoff(4))
+
+	jittered := RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		backoff := jittered.backoff(2)
+		require.True(t, backoff > 100*time.Millisecond && backoff <= 200*time.Millisecond, "backoff: %v", backoff)
+	}
+}
+
+func TestRetryPolicyMaxAttempts(t *testing.T) {
+	require.Equal(t, 1, RetryPolicy{}.maxAttempts())
+	require.Equal(t, 3, DefaultRetryPolicy().maxAttempts())
+	require.True(t, DefaultRetryPolicy().isRetryableStatusCode(http.StatusServiceUnavailable))
+	require.False(t, DefaultRetryPolicy().isRetryableStatusCode(http.StatusUnauthorized))
+}
@@ -0,0 +1,115 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+)
+
+// DefaultTLSSessionCacheSize is the default number of TLS sessions kept to resume connections to Astra nodes.
+const DefaultTLSSessionCacheSize = 1024
+
+// HandshakeStats counts the TLS handshakes made with Astra nodes.
+type HandshakeStats struct {
+	// Full is the number of handshakes that negotiated a new session.
+	Full uint64
+	// Resumed is the number of handshakes that resumed a cached session.
+	Resumed uint64
+}
+
+// tlsSessionCache is a TLS session cache shared by every connection of the dialer that evicts the least recently
+// used session when it's full.
+type tlsSessionCache struct {
+	capacity int
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List // Most recently used first
+}
+
+type tlsSessionCacheEntry struct {
+	key   string
+	state *tls.ClientSessionState
+}
+
+func newTLSSessionCache(capacity int) *tlsSessionCache {
+	return &tlsSessionCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *tlsSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*tlsSessionCacheEntry).state, true
+}
+
+func (c *tlsSessionCache) Put(key string, state *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		if state == nil {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		} else {
+			elem.Value.(*tlsSessionCacheEntry).state = state
+			c.lru.MoveToFront(elem)
+		}
+		return
+	}
+	if state == nil {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&tlsSessionCacheEntry{key: key, state: state})
+	if c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tlsSessionCacheEntry).key)
+	}
+}
+
+// scoped returns a view of the cache whose keys are prefixed by prefix. The TLS stack keys sessions by server name,
+// the host ID of the node, so the prefix distinguishes the SNI proxy and the bundle used to reach it.
+func (c *tlsSessionCache) scoped(prefix string) tls.ClientSessionCache {
+	return &scopedTLSSessionCache{cache: c, prefix: prefix}
+}
+
+type scopedTLSSessionCache struct {
+	cache  *tlsSessionCache
+	prefix string
+}
+
+func (s *scopedTLSSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	return s.cache.Get(s.prefix + key)
+}
+
+func (s *scopedTLSSessionCache) Put(key string, state *tls.ClientSessionState) {
+	s.cache.Put(s.prefix+key, state)
+}
+
+func (d *dialer) HandshakeStats() HandshakeStats {
+	return HandshakeStats{
+		Full:    d.fullHandshakes.Load(),
+		Resumed: d.resumedHandshakes.Load(),
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSSessionCacheEviction(t *testing.T) {
+	cache := newTLSSessionCache(2)
+	a, b, c := &tls.ClientSessionState{}, &tls.ClientSessionState{}, &tls.ClientSessionState{}
+	cache.Put("a", a)
+	cache.Put("b", b)
+
+	// Getting a makes b the least recently used
+	state, ok := cache.Get("a")
+	require.True(t, ok)
+	require.Same(t, a, state)
+	cache.Put("c", c)
+
+	_, ok = cache.Get("b")
+	require.False(t, ok)
+	state, ok = cache.Get("a")
+	require.True(t, ok)
+	require.Same(t, a, state)
+	state, ok = cache.Get("c")
+	require.True(t, ok)
+	require.Same(t, c, state)
+	require.Equal(t, 2, cache.lru.Len())
+}
+
+func TestTLSSessionCachePutNil(t *testing.T) {
+	cache := newTLSSessionCache(2)
+	cache.Put("a", &tls.ClientSessionState{})
+	cache.Put("a", nil)
+	_, ok := cache.Get("a")
+	require.False(t, ok)
+	require.Empty(t, cache.entries)
+	require.Zero(t, cache.lru.Len())
+
+	cache.Put("b", nil)
+	require.Empty(t, cache.entries)
+}
+
+// handshakeNode makes a TLS handshake with hostId at addr, and a request so that the session tickets it sends after
+// the handshake are received.
+func handshakeNode(t *testing.T, d *dialer, addr, hostId string) {
+	t.Helper()
+	conn, err := d.dialAddr(context.Background(), addr, addr, hostId)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", hostId)
+	require.NoError(t, err)
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	ca := newTestCA(t)
+	server := startTestServer(t, ca, http.NotFoundHandler())
+	d := newTestDialer(t, serverBundle(t, ca, server))
+	addr := server.Listener.Addr().String()
+
+	handshakeNode(t, d, addr, "node")
+	require.Equal(t, HandshakeStats{Full: 1}, d.HandshakeStats())
+	handshakeNode(t, d, addr, "node")
+	require.Equal(t, HandshakeStats{Full: 1, Resumed: 1}, d.HandshakeStats())
+
+	// A session of another bundle isn't resumed
+	reloaded := *d.bundle.Load()
+	reloaded.Version = "other"
+	d.bundle.Store(&reloaded)
+	handshakeNode(t, d, addr, "node")
+	require.Equal(t, HandshakeStats{Full: 2, Resumed: 1}, d.HandshakeStats())
+	handshakeNode(t, d, addr, "node")
+	require.Equal(t, HandshakeStats{Full: 2, Resumed: 2}, d.HandshakeStats())
+}
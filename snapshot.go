@@ -0,0 +1,131 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+	"github.com/datastax/cql-proxy/astra"
+)
+
+// metadataSnapshot is the last metadata successfully retrieved from the Astra metadata service, as persisted to
+// disk.
+type metadataSnapshot struct {
+	// Endpoint is the metadata service the snapshot was retrieved from, so a snapshot of another database is never
+	// used.
+	Endpoint string         `json:"endpoint"`
+	SavedAt  time.Time      `json:"saved_at"`
+	Metadata *astraMetadata `json:"metadata"`
+}
+
+func bundleEndpoint(bundle *astra.Bundle) string {
+	return fmt.Sprintf("%s:%d", bundle.Host, bundle.Port)
+}
+
+// saveMetadataSnapshot persists metadata, if the dialer is configured with a snapshot path and it changed since
+// previous was resolved.
+func (d *dialer) saveMetadataSnapshot(metadata, previous *astraMetadata) {
+	if d.metadataSnapshotPath == "" || (previous != nil && !previous.degraded && reflect.DeepEqual(metadata, previous)) {
+		return
+	}
+	data, err := json.Marshal(&metadataSnapshot{
+		Endpoint: bundleEndpoint(d.bundle.Load().Bundle),
+		SavedAt:  time.Now(),
+		Metadata: metadata,
+	})
+	if err == nil {
+		err = writeFileAtomic(d.metadataSnapshotPath, data)
+	}
+	if err != nil {
+		d.logger.Warning("Unable to save Astra metadata snapshot.",
+			gocql.NewLogFieldString("path", d.metadataSnapshotPath),
+			gocql.NewLogFieldError("error", err))
+	}
+}
+
+// loadMetadataSnapshot returns the persisted metadata, marked as degraded.
+func (d *dialer) loadMetadataSnapshot() (*astraMetadata, time.Time, error) {
+	data, err := os.ReadFile(d.metadataSnapshotPath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var snapshot metadataSnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid Astra metadata snapshot: %w", err)
+	}
+	if endpoint := bundleEndpoint(d.bundle.Load().Bundle); snapshot.Endpoint != endpoint {
+		return nil, time.Time{}, fmt.Errorf("Astra metadata snapshot was saved for %s instead of %s", snapshot.Endpoint, endpoint)
+	}
+	metadata := snapshot.Metadata
+	if metadata == nil || metadata.ContactInfo.SniProxyAddress == "" || len(metadata.ContactInfo.ContactPoints) == 0 {
+		return nil, time.Time{}, errors.New("incomplete Astra metadata snapshot")
+	}
+	metadata.degraded = true
+	return metadata, snapshot.SavedAt, nil
+}
+
+// readMetadataSnapshot returns the persisted metadata and when it was saved, or nil if there's no usable snapshot.
+// It reads the file so it must be called without holding d.mu.
+func (d *dialer) readMetadataSnapshot() (*astraMetadata, time.Time) {
+	if d.metadataSnapshotPath == "" {
+		return nil, time.Time{}
+	}
+	metadata, savedAt, err := d.loadMetadataSnapshot()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			d.logger.Warning("Unable to load Astra metadata snapshot.",
+				gocql.NewLogFieldString("path", d.metadataSnapshotPath),
+				gocql.NewLogFieldError("error", err))
+		}
+		return nil, time.Time{}
+	}
+	return metadata, savedAt
+}
+
+// useMetadataSnapshotLocked falls back to metadata, read from the snapshot, when the metadata service can't be
+// reached before any metadata was resolved. d.mu must be held.
+func (d *dialer) useMetadataSnapshotLocked(metadata *astraMetadata, savedAt time.Time, fetchErr error) {
+	d.metadata = metadata
+	d.logger.Warning("Unable to resolve Astra metadata, using the persisted snapshot until the metadata service is reachable.",
+		gocql.NewLogFieldString("path", d.metadataSnapshotPath),
+		gocql.NewLogFieldString("saved_at", savedAt.Format(time.RFC3339)),
+		gocql.NewLogFieldString("sni_proxy_addr", metadata.ContactInfo.SniProxyAddress),
+		gocql.NewLogFieldString("contact_points", strings.Join(metadata.ContactInfo.ContactPoints, ",")),
+		gocql.NewLogFieldError("error", fetchErr))
+}
+
+// scheduleDegradedRefresh retries fetching the metadata after delay while the dialer is running on a snapshot, even
+// if no connection is dialed in the meantime.
+func (d *dialer) scheduleDegradedRefresh(delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		select {
+		case <-d.closed:
+			return
+		default:
+		}
+		d.mu.Lock()
+		if d.metadata != nil && d.metadata.degraded {
+			d.startMetadataCallLocked()
+		}
+		d.mu.Unlock()
+	})
+}
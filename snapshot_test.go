@@ -0,0 +1,41 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataSnapshotFallback(t *testing.T) {
+	d := newTestDialer(t, unreachableBundle(t), WithMetadataSnapshot(filepath.Join(t.TempDir(), "metadata.json")))
+
+	_, err := d.refreshMetadata(context.Background())
+	require.Error(t, err, "no snapshot yet")
+
+	saved := &astraMetadata{Version: 1, Region: "us-east1", ContactInfo: contactInfo{SniProxyAddress: "ingress:29042", ContactPoints: []string{"a", "b"}}}
+	d.saveMetadataSnapshot(saved, nil)
+
+	metadata, err := d.refreshMetadata(context.Background())
+	require.NoError(t, err)
+	require.True(t, metadata.degraded)
+	require.Equal(t, saved.ContactInfo, metadata.ContactInfo)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	require.Same(t, metadata, d.metadata)
+}
@@ -0,0 +1,209 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Proxy is a SOCKS5 (RFC 1928) proxy, with optional username/password authentication (RFC 1929).
+type socks5Proxy struct {
+	addr     string
+	username string
+	password string
+}
+
+// dialContext opens a connection to addr through the proxy. The proxy resolves addr, so it may be a hostname that
+// isn't resolvable locally.
+func (p *socks5Proxy) dialContext(ctx context.Context, dial dialContextFunc, network, addr string) (_ net.Conn, err error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("unsupported network %q for SOCKS5 proxy", network)
+	}
+	conn, err := dial(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SOCKS5 proxy %v: %w", p.addr, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() {
+			_ = conn.SetDeadline(time.Time{})
+		}()
+	}
+	stop := closeOnDone(ctx, conn)
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+	}()
+
+	if err = p.authenticate(conn); err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy %v: %w", p.addr, err)
+	}
+	if err = p.connect(conn, addr); err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy %v unable to connect to %v: %w", p.addr, addr, err)
+	}
+	return conn, nil
+}
+
+func (p *socks5Proxy) authenticate(conn net.Conn) error {
+	methods := []byte{socks5AuthNone}
+	if p.username != "" || p.password != "" {
+		methods = []byte{socks5AuthPassword}
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if len(p.username) > 255 || len(p.password) > 255 {
+			return errors.New("username and password must be at most 255 bytes")
+		}
+		req := []byte{socks5PasswordVersion, byte(len(p.username))}
+		req = append(req, p.username...)
+		req = append(req, byte(len(p.password)))
+		req = append(req, p.password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("username/password authentication failed")
+		}
+		return nil
+	case socks5AuthNoAcceptable:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", resp[1])
+	}
+}
+
+func (p *socks5Proxy) connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AddrIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AddrIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("hostname %q is too long", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [4]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", resp[0])
+	}
+	if resp[1] != 0x00 {
+		if msg, ok := socks5Replies[resp[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("unknown reply code %d", resp[1])
+	}
+
+	// Discard the bound address, it isn't needed to use the connection.
+	var boundLen int
+	switch resp[3] {
+	case socks5AddrIPv4:
+		boundLen = net.IPv4len
+	case socks5AddrIPv6:
+		boundLen = net.IPv6len
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		boundLen = int(l[0])
+	default:
+		return fmt.Errorf("unknown bound address type %d", resp[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundLen+2))
+	return err
+}
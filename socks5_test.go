@@ -0,0 +1,208 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pipeDial returns a dial function connected to a fake SOCKS5 proxy running serve, and a channel with the error
+// returned by serve.
+func pipeDial(serve func(conn net.Conn) error) (dialContextFunc, <-chan error) {
+	served := make(chan error, 1)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			served <- serve(server)
+		}()
+		return client, nil
+	}, served
+}
+
+// expect reads len(want) bytes from conn and checks they're equal to want.
+func expect(conn net.Conn, want []byte) error {
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if string(got) != string(want) {
+		return &unexpectedBytesError{got: got, want: want}
+	}
+	return nil
+}
+
+type unexpectedBytesError struct {
+	got, want []byte
+}
+
+func (e *unexpectedBytesError) Error() string {
+	return "unexpected bytes"
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	dial, served := pipeDial(func(conn net.Conn) error {
+		if err := expect(conn, []byte{0x05, 0x01, 0x00}); err != nil {
+			return err
+		}
+		_, _ = conn.Write([]byte{0x05, 0x00})
+		req := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len("sni.example"))}, "sni.example"...)
+		if err := expect(conn, append(req, 0x71, 0x62)); err != nil { // Port 29026
+			return err
+		}
+		_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 10, 0, 0, 1, 0x71, 0x62})
+		_, _ = conn.Write([]byte("hello"))
+		return nil
+	})
+
+	proxy := &socks5Proxy{addr: "proxy:1080"}
+	conn, err := proxy.dialContext(context.Background(), dial, "tcp", "sni.example:29026")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+	require.NoError(t, <-served)
+}
+
+func TestSOCKS5PasswordAuthentication(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status byte
+		err    string
+	}{
+		{name: "accepted", status: 0x00},
+		{name: "rejected", status: 0x01, err: "username/password authentication failed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dial, served := pipeDial(func(conn net.Conn) error {
+				if err := expect(conn, []byte{0x05, 0x01, 0x02}); err != nil {
+					return err
+				}
+				_, _ = conn.Write([]byte{0x05, 0x02})
+				if err := expect(conn, []byte("\x01\x04user\x06secret")); err != nil {
+					return err
+				}
+				_, _ = conn.Write([]byte{0x01, tc.status})
+				if tc.status != 0x00 {
+					return nil
+				}
+				if err := expect(conn, []byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 2, 0x23, 0x52}); err != nil {
+					return err
+				}
+				_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+				return nil
+			})
+
+			proxy := &socks5Proxy{addr: "proxy:1080", username: "user", password: "secret"}
+			conn, err := proxy.dialContext(context.Background(), dial, "tcp", "10.0.0.2:9042")
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+				_ = conn.Close()
+			}
+			require.NoError(t, <-served)
+		})
+	}
+}
+
+func TestSOCKS5NoAcceptableMethod(t *testing.T) {
+	dial, _ := pipeDial(func(conn net.Conn) error {
+		if err := expect(conn, []byte{0x05, 0x01, 0x00}); err != nil {
+			return err
+		}
+		_, err := conn.Write([]byte{0x05, 0xff})
+		return err
+	})
+
+	proxy := &socks5Proxy{addr: "proxy:1080"}
+	_, err := proxy.dialContext(context.Background(), dial, "tcp", "sni.example:29042")
+	require.ErrorContains(t, err, "no acceptable authentication method")
+}
+
+func TestSOCKS5ReplyCodes(t *testing.T) {
+	for code, msg := range map[byte]string{
+		0x01: "general SOCKS server failure",
+		0x05: "connection refused",
+		0x09: "unknown reply code 9",
+	} {
+		dial, _ := pipeDial(func(conn net.Conn) error {
+			if err := expect(conn, []byte{0x05, 0x01, 0x00}); err != nil {
+				return err
+			}
+			_, _ = conn.Write([]byte{0x05, 0x00})
+			if err := expect(conn, []byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x23, 0x52}); err != nil {
+				return err
+			}
+			_, err := conn.Write([]byte{0x05, code, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return err
+		})
+
+		proxy := &socks5Proxy{addr: "proxy:1080"}
+		_, err := proxy.dialContext(context.Background(), dial, "tcp", "10.0.0.1:9042")
+		require.ErrorContains(t, err, msg)
+	}
+}
+
+func TestSOCKS5BoundAddress(t *testing.T) {
+	for name, bound := range map[string][]byte{
+		"ipv4":   {0x01, 10, 0, 0, 1},
+		"ipv6":   append([]byte{0x04}, net.ParseIP("2001:db8::1")...),
+		"domain": append([]byte{0x03, byte(len("bound.example"))}, "bound.example"...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dial, served := pipeDial(func(conn net.Conn) error {
+				if err := expect(conn, []byte{0x05, 0x01, 0x00}); err != nil {
+					return err
+				}
+				_, _ = conn.Write([]byte{0x05, 0x00})
+				// The target is an IPv6 address
+				req := append([]byte{0x05, 0x01, 0x00, 0x04}, net.ParseIP("2001:db8::2")...)
+				if err := expect(conn, append(req, 0x23, 0x52)); err != nil {
+					return err
+				}
+				reply := append(append([]byte{0x05, 0x00, 0x00}, bound...), 0x23, 0x52)
+				_, _ = conn.Write(append(reply, "data"...))
+				return nil
+			})
+
+			proxy := &socks5Proxy{addr: "proxy:1080"}
+			conn, err := proxy.dialContext(context.Background(), dial, "tcp", "[2001:db8::2]:9042")
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// The bound address must be consumed entirely, so the tunnel starts right after it
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			require.Equal(t, "data", string(buf))
+			require.NoError(t, <-served)
+		})
+	}
+}
+
+func TestSOCKS5UnsupportedNetwork(t *testing.T) {
+	proxy := &socks5Proxy{addr: "proxy:1080"}
+	_, err := proxy.dialContext(context.Background(), nil, "udp", "sni.example:29042")
+	require.ErrorContains(t, err, "unsupported network")
+}
@@ -0,0 +1,226 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// TLSPolicy restricts the TLS parameters used to connect to the Astra metadata service and to the nodes. Zero values
+// keep the defaults of the bundle and of crypto/tls.
+type TLSPolicy struct {
+	// Name identifies the policy in errors.
+	Name string
+	// MinVersion and MaxVersion bound the TLS version, for instance tls.VersionTLS13.
+	MinVersion uint16
+	MaxVersion uint16
+	// CipherSuites are the allowed TLS 1.0-1.2 cipher suites. TLS 1.3 cipher suites can't be configured.
+	CipherSuites []uint16
+	// CurvePreferences are the allowed elliptic curves for key exchange.
+	CurvePreferences []tls.CurveID
+	// FIPS requires the policy and the certificates of the bundle to only use FIPS-approved algorithms, which is
+	// checked when the dialer is created and when its bundle is reloaded.
+	FIPS bool
+}
+
+// FIPSTLSPolicy returns a policy that only allows FIPS-approved algorithms: TLS 1.2 with ECDHE key exchange on the
+// NIST P-256 or P-384 curves and AES-GCM cipher suites. TLS 1.3 is disabled because crypto/tls doesn't allow
+// excluding its ChaCha20-Poly1305 cipher suite. The bundle's certificates must use RSA keys of at least 2048 bits,
+// or ECDSA keys on the P-256, P-384 or P-521 curves, signed with SHA-2.
+func FIPSTLSPolicy() TLSPolicy {
+	return TLSPolicy{
+		Name:       "fips",
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+		FIPS:             true,
+	}
+}
+
+var fipsCipherSuites = map[uint16]bool{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: true,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   true,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   true,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         true,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         true,
+}
+
+var fipsCurves = map[tls.CurveID]bool{
+	tls.CurveP256: true,
+	tls.CurveP384: true,
+	tls.CurveP521: true,
+}
+
+var fipsSignatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+	x509.SHA256WithRSA:    true,
+	x509.SHA384WithRSA:    true,
+	x509.SHA512WithRSA:    true,
+	x509.SHA256WithRSAPSS: true,
+	x509.SHA384WithRSAPSS: true,
+	x509.SHA512WithRSAPSS: true,
+	x509.ECDSAWithSHA256:  true,
+	x509.ECDSAWithSHA384:  true,
+	x509.ECDSAWithSHA512:  true,
+}
+
+// validate checks that the policy is consistent and, for a FIPS policy, that it only allows approved algorithms.
+func (p *TLSPolicy) validate() error {
+	if p.MinVersion != 0 && p.MaxVersion != 0 && p.MinVersion > p.MaxVersion {
+		return p.errorf("minimum version %s is above maximum version %s",
+			tlsVersionName(p.MinVersion), tlsVersionName(p.MaxVersion))
+	}
+	known := make(map[uint16]bool)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.ID] = true
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.ID] = true
+	}
+	for _, id := range p.CipherSuites {
+		if !known[id] {
+			return p.errorf("unknown cipher suite 0x%04x", id)
+		}
+	}
+	if !p.FIPS {
+		return nil
+	}
+	if p.MinVersion < tls.VersionTLS12 {
+		return p.errorf("FIPS requires a minimum version of TLS 1.2")
+	}
+	if p.MaxVersion == 0 || p.MaxVersion > tls.VersionTLS12 {
+		return p.errorf("FIPS requires a maximum version of TLS 1.2, TLS 1.3 cipher suites can't be restricted")
+	}
+	if len(p.CipherSuites) == 0 {
+		return p.errorf("FIPS requires the cipher suites to be restricted")
+	}
+	for _, id := range p.CipherSuites {
+		if !fipsCipherSuites[id] {
+			return p.errorf("cipher suite %s isn't FIPS-approved", tls.CipherSuiteName(id))
+		}
+	}
+	if len(p.CurvePreferences) == 0 {
+		return p.errorf("FIPS requires the curves to be restricted")
+	}
+	for _, curve := range p.CurvePreferences {
+		if !fipsCurves[curve] {
+			return p.errorf("curve %s isn't FIPS-approved", curve)
+		}
+	}
+	return nil
+}
+
+// validateBundle checks that the bundle's certificates satisfy a FIPS policy. The CA certificates must be known,
+// which is only the case when the bundle was loaded from its zip file.
+func (p *TLSPolicy) validateBundle(loaded *LoadedBundle) error {
+	if !p.FIPS {
+		return nil
+	}
+	var certs []*x509.Certificate
+	if loaded.Bundle != nil && loaded.Bundle.TLSConfig != nil {
+		for _, cert := range loaded.Bundle.TLSConfig.Certificates {
+			for _, der := range cert.Certificate {
+				parsed, err := x509.ParseCertificate(der)
+				if err != nil {
+					return p.errorf("invalid bundle client certificate: %v", err)
+				}
+				certs = append(certs, parsed)
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return p.errorf("bundle has no client certificate")
+	}
+	if len(loaded.CACertificates) == 0 {
+		// They can't be retrieved from the bundle's TLS configuration
+		return p.errorf("bundle CA certificates are unknown, load the bundle from its zip file to check them")
+	}
+	for _, cert := range append(certs, loaded.CACertificates...) {
+		if err := checkFIPSCertificate(cert); err != nil {
+			return p.errorf("bundle certificate %q: %v", cert.Subject.String(), err)
+		}
+	}
+	return nil
+}
+
+func checkFIPSCertificate(cert *x509.Certificate) error {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return fmt.Errorf("RSA key of %d bits is below the 2048 bits approved by FIPS", key.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if curve := key.Curve; curve != elliptic.P256() && curve != elliptic.P384() && curve != elliptic.P521() {
+			return fmt.Errorf("ECDSA curve %s isn't FIPS-approved", curve.Params().Name)
+		}
+	default:
+		return fmt.Errorf("%s key isn't FIPS-approved", cert.PublicKeyAlgorithm)
+	}
+	// Self-signed roots are trusted as is, so their own signature doesn't matter
+	if !fipsSignatureAlgorithms[cert.SignatureAlgorithm] && !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+		return fmt.Errorf("signature algorithm %s isn't FIPS-approved", cert.SignatureAlgorithm)
+	}
+	return nil
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func (p *TLSPolicy) errorf(format string, args ...interface{}) error {
+	name := p.Name
+	if name == "" {
+		name = "custom"
+	}
+	return fmt.Errorf("TLS policy %q: %s", name, fmt.Sprintf(format, args...))
+}
+
+// apply restricts tlsConfig to the policy.
+func (p *TLSPolicy) apply(tlsConfig *tls.Config) {
+	if p.MinVersion != 0 {
+		tlsConfig.MinVersion = p.MinVersion
+	}
+	if p.MaxVersion != 0 {
+		tlsConfig.MaxVersion = p.MaxVersion
+	}
+	if len(p.CipherSuites) > 0 {
+		tlsConfig.CipherSuites = append([]uint16(nil), p.CipherSuites...)
+	}
+	if len(p.CurvePreferences) > 0 {
+		tlsConfig.CurvePreferences = append([]tls.CurveID(nil), p.CurvePreferences...)
+	}
+}
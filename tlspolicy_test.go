@@ -0,0 +1,146 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSPolicyValidate(t *testing.T) {
+	fips := func(edit func(p *TLSPolicy)) TLSPolicy {
+		p := FIPSTLSPolicy()
+		edit(&p)
+		return p
+	}
+	for _, tc := range []struct {
+		name   string
+		policy TLSPolicy
+		valid  bool
+	}{
+		{"zero", TLSPolicy{}, true},
+		{"fips", FIPSTLSPolicy(), true},
+		{"tls 1.3 only", TLSPolicy{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS13}, true},
+		{"minimum above maximum", TLSPolicy{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS12}, false},
+		{"unknown cipher suite", TLSPolicy{CipherSuites: []uint16{0xfefe}}, false},
+		{"fips minimum below tls 1.2", fips(func(p *TLSPolicy) { p.MinVersion = tls.VersionTLS11 }), false},
+		{"fips without minimum", fips(func(p *TLSPolicy) { p.MinVersion = 0 }), false},
+		{"fips maximum tls 1.3", fips(func(p *TLSPolicy) { p.MaxVersion = tls.VersionTLS13 }), false},
+		{"fips without maximum", fips(func(p *TLSPolicy) { p.MaxVersion = 0 }), false},
+		{"fips without cipher suites", fips(func(p *TLSPolicy) { p.CipherSuites = nil }), false},
+		{"fips chacha20", fips(func(p *TLSPolicy) {
+			p.CipherSuites = append(p.CipherSuites, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256)
+		}), false},
+		{"fips cbc", fips(func(p *TLSPolicy) { p.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA} }), false},
+		{"fips without curves", fips(func(p *TLSPolicy) { p.CurvePreferences = nil }), false},
+		{"fips x25519", fips(func(p *TLSPolicy) { p.CurvePreferences = []tls.CurveID{tls.X25519} }), false},
+		{"fips p521", fips(func(p *TLSPolicy) { p.CurvePreferences = []tls.CurveID{tls.CurveP521} }), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.validate()
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestTLSPolicyValidateBundle(t *testing.T) {
+	policy := FIPSTLSPolicy()
+	loaded := newTestCA(t).loadedBundle(t, "127.0.0.1", 29080)
+	require.NoError(t, policy.validateBundle(loaded))
+
+	// The CA certificates can't be checked
+	require.Error(t, policy.validateBundle(NewLoadedBundle(loaded.Bundle)))
+	_, err := newDialer(NewLoadedBundle(loaded.Bundle), 0, nil, []DialerOption{WithTLSPolicy(policy)})
+	require.Error(t, err)
+
+	noClientCert := *loaded.Bundle
+	noClientCert.TLSConfig = &tls.Config{}
+	require.Error(t, policy.validateBundle(&LoadedBundle{Bundle: &noClientCert, CACertificates: loaded.CACertificates}))
+
+	// Only checked for a FIPS policy
+	require.NoError(t, (&TLSPolicy{}).validateBundle(NewLoadedBundle(loaded.Bundle)))
+}
+
+func TestCheckFIPSCertificate(t *testing.T) {
+	rsaCAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaCA, _ := issueTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "RSA CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, rsaCAKey, nil, rsaCAKey)
+	rsa1024Key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	require.NoError(t, err)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	issue := func(key crypto.Signer, algorithm x509.SignatureAlgorithm, isCA bool) *x509.Certificate {
+		cert, _ := issueTestCertificate(t, &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "issued"},
+			SignatureAlgorithm:    algorithm,
+			IsCA:                  isCA,
+			BasicConstraintsValid: isCA,
+		}, key, rsaCA, rsaCAKey)
+		return cert
+	}
+	sha1Root, _ := issueTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "SHA-1 root"},
+		SignatureAlgorithm:    x509.SHA1WithRSA,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, rsaCAKey, nil, rsaCAKey)
+
+	for _, tc := range []struct {
+		name  string
+		cert  *x509.Certificate
+		valid bool
+	}{
+		{"rsa 2048 root", rsaCA, true},
+		{"rsa 1024", issue(rsa1024Key, x509.SHA256WithRSA, false), false},
+		{"ecdsa p384", issue(p384Key, x509.SHA384WithRSA, false), true},
+		{"ecdsa p224", issue(p224Key, x509.SHA256WithRSA, false), false},
+		{"ed25519", issue(ed25519Key, x509.SHA256WithRSA, false), false},
+		{"sha-1 signed intermediate", issue(p384Key, x509.SHA1WithRSA, true), false},
+		{"sha-1 signed root", sha1Root, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkFIPSCertificate(tc.cert)
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
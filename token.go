@@ -0,0 +1,122 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+)
+
+// DefaultTokenTimeout bounds how long TokenAuthenticator waits for its provider when a connection authenticates.
+const DefaultTokenTimeout = 10 * time.Second
+
+// TokenProvider provides the current Astra application token, so it can be rotated without recreating the session.
+type TokenProvider interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticTokenProvider always provides the same token.
+type StaticTokenProvider string
+
+func (p StaticTokenProvider) Token(_ context.Context) (string, error) {
+	if p == "" {
+		return "", errors.New("no Astra application token")
+	}
+	return string(p), nil
+}
+
+// TokenProviderFunc adapts a function, for instance one querying a secret manager, to a TokenProvider.
+type TokenProviderFunc func(ctx context.Context) (string, error)
+
+func (f TokenProviderFunc) Token(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// FileTokenProvider provides the token stored in a file, such as a mounted Kubernetes secret. The file is read again
+// whenever its modification time or size changes, and surrounding whitespace is ignored.
+type FileTokenProvider struct {
+	Path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+// NewFileTokenProvider returns a provider of the token stored in the file at path.
+func NewFileTokenProvider(path string) *FileTokenProvider {
+	return &FileTokenProvider{Path: path}
+}
+
+func (p *FileTokenProvider) Token(_ context.Context) (string, error) {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read Astra application token: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return p.token, nil
+	}
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read Astra application token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("Astra application token file %s is empty", p.Path)
+	}
+	p.token, p.modTime, p.size = token, info.ModTime(), info.Size()
+	return token, nil
+}
+
+// TokenAuthenticator authenticates connections to Astra with the application token of Provider. The token is
+// requested for every new connection, so connections opened after the token was rotated use the new one.
+type TokenAuthenticator struct {
+	Provider TokenProvider
+	// Timeout bounds how long the provider is waited for. DefaultTokenTimeout is used when it's zero.
+	Timeout time.Duration
+}
+
+// NewTokenAuthenticator returns an authenticator that uses the token of provider.
+func NewTokenAuthenticator(provider TokenProvider) *TokenAuthenticator {
+	return &TokenAuthenticator{Provider: provider}
+}
+
+func (a *TokenAuthenticator) Challenge(req []byte) ([]byte, gocql.Authenticator, error) {
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTokenTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	token, err := a.Provider.Token(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get Astra application token: %w", err)
+	}
+	return gocql.PasswordAuthenticator{Username: "token", Password: token}.Challenge(req)
+}
+
+func (a *TokenAuthenticator) Success(_ []byte) error {
+	return nil
+}
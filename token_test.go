@@ -0,0 +1,90 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTokenProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeToken := func(token string, modTime time.Time) {
+		require.NoError(t, os.WriteFile(path, []byte(token), 0o600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	provider := NewFileTokenProvider(path)
+
+	writeToken("AstraCS:first\n", modTime)
+	token, err := provider.Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "AstraCS:first", token)
+
+	// Same modification time and size: the cached token is used
+	writeToken("AstraCS:other\n", modTime)
+	token, err = provider.Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "AstraCS:first", token)
+
+	// The modification time changed
+	modTime = modTime.Add(time.Minute)
+	writeToken("AstraCS:other\n", modTime)
+	token, err = provider.Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "AstraCS:other", token)
+
+	// The size changed
+	writeToken("AstraCS:rotated\n", modTime)
+	token, err = provider.Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "AstraCS:rotated", token)
+}
+
+func TestFileTokenProviderEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte(" \n"), 0o600))
+	_, err := NewFileTokenProvider(path).Token(context.Background())
+	require.ErrorContains(t, err, "is empty")
+
+	_, err = NewFileTokenProvider(filepath.Join(t.TempDir(), "missing")).Token(context.Background())
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestTokenAuthenticatorRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("AstraCS:first"), 0o600))
+	authenticator := NewTokenAuthenticator(NewFileTokenProvider(path))
+	const class = "org.apache.cassandra.auth.PasswordAuthenticator"
+
+	resp, next, err := authenticator.Challenge([]byte(class))
+	require.NoError(t, err)
+	require.Nil(t, next)
+	require.Equal(t, "\x00token\x00AstraCS:first", string(resp))
+
+	require.NoError(t, os.WriteFile(path, []byte("AstraCS:rotated"), 0o600))
+	resp, _, err = authenticator.Challenge([]byte(class))
+	require.NoError(t, err)
+	require.Equal(t, "\x00token\x00AstraCS:rotated", string(resp))
+
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	_, _, err = authenticator.Challenge([]byte(class))
+	require.ErrorContains(t, err, "unable to get Astra application token")
+}
@@ -0,0 +1,186 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	gocql "github.com/apache/cassandra-gocql-driver/v2"
+)
+
+// DefaultUnknownHostThreshold is the number of consecutive failed TLS handshakes with a node after which it's
+// considered to no longer be part of the cluster by default.
+const DefaultUnknownHostThreshold = 3
+
+// UnknownHostError is returned by DialHost when the TLS handshake with a node keeps failing even though the SNI
+// proxy can be reached. This happens when Astra replaced the node: the SNI proxy no longer knows its host ID. It's
+// only returned once the Astra metadata was refreshed and a handshake with one of its contact points succeeded
+// through the same SNI proxy, showing that the failures are specific to the node. It's then returned for every failed
+// handshake with the node until it's dialed successfully or checked again.
+type UnknownHostError struct {
+	// HostID is the host ID of the node.
+	HostID string
+	// Failures is the number of consecutive failed TLS handshakes with the node.
+	Failures int
+	// Err is the error of the last failed TLS handshake.
+	Err error
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("Astra node %v is no longer part of the cluster after %d failed TLS handshakes: %v", e.HostID, e.Failures, e.Err)
+}
+
+func (e *UnknownHostError) Unwrap() error {
+	return e.Err
+}
+
+// hostFailureRetention is how long the failures of a node that isn't dialed anymore are remembered. Replaced nodes
+// never succeed again, so they're dropped once the driver stops dialing them.
+const hostFailureRetention = 10 * time.Minute
+
+// hostFailureTracker counts the consecutive failed TLS handshakes with each node, and remembers the nodes confirmed
+// to no longer be part of the cluster.
+type hostFailureTracker struct {
+	threshold int
+	mu        sync.Mutex
+	hosts     map[string]*hostFailures
+	lastPrune time.Time
+}
+
+type hostFailures struct {
+	failures    int
+	lastFailure time.Time
+	lastCheck   time.Time
+	unknown     bool // The last check confirmed the node is no longer part of the cluster
+}
+
+func newHostFailureTracker(threshold int) *hostFailureTracker {
+	return &hostFailureTracker{
+		threshold: threshold,
+		hosts:     make(map[string]*hostFailures),
+	}
+}
+
+// record updates the failure count of hostId after a dial. It returns the number of consecutive failures, whether
+// the threshold was reached and hostId wasn't checked recently, meaning it should be checked now, and whether the
+// last check, made recently, confirmed that hostId is no longer part of the cluster.
+func (t *hostFailureTracker) record(hostId string, handshakeFailed bool) (int, bool, bool) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pruneLocked(now)
+	if !handshakeFailed {
+		delete(t.hosts, hostId)
+		return 0, false, false
+	}
+	h := t.hosts[hostId]
+	if h == nil {
+		h = &hostFailures{}
+		t.hosts[hostId] = h
+	}
+	h.failures++
+	h.lastFailure = now
+	if t.threshold <= 0 || h.failures < t.threshold {
+		return h.failures, false, false
+	}
+	if now.Sub(h.lastCheck) < metadataRefreshRetryInterval {
+		return h.failures, false, h.unknown
+	}
+	h.lastCheck = now
+	h.unknown = false
+	return h.failures, true, false
+}
+
+// confirmUnknown remembers that the check of hostId confirmed it's no longer part of the cluster, until it's dialed
+// successfully or checked again.
+func (t *hostFailureTracker) confirmUnknown(hostId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h := t.hosts[hostId]; h != nil {
+		h.unknown = true
+	}
+}
+
+// pruneLocked drops the nodes that didn't fail for hostFailureRetention, at most once per retention period. t.mu
+// must be held.
+func (t *hostFailureTracker) pruneLocked(now time.Time) {
+	if now.Sub(t.lastPrune) < hostFailureRetention {
+		return
+	}
+	t.lastPrune = now
+	for hostId, h := range t.hosts {
+		if now.Sub(h.lastFailure) >= hostFailureRetention {
+			delete(t.hosts, hostId)
+		}
+	}
+}
+
+// checkUnknownHost records the outcome of dialing the node hostId through the SNI proxy sniAddr. When the TLS
+// handshake with it keeps failing, it refreshes the metadata and makes a handshake with another contact point
+// through the same SNI proxy. If that succeeds, the SNI proxy no longer knows hostId and an UnknownHostError is
+// returned in place of err, as it is for the following failures until hostId is checked again. Otherwise err is
+// returned.
+func (d *dialer) checkUnknownHost(ctx context.Context, sniAddr, hostId string, err error) error {
+	var hsErr *handshakeError
+	handshakeFailed := err != nil && errors.As(err, &hsErr)
+	if err != nil && !handshakeFailed {
+		// The SNI proxy couldn't be reached, that says nothing about the node.
+		return err
+	}
+
+	failures, check, unknown := d.hostFailures.record(hostId, handshakeFailed)
+	if unknown {
+		return &UnknownHostError{HostID: hostId, Failures: failures, Err: err}
+	}
+	if !check {
+		return err
+	}
+
+	d.logger.Warning("TLS handshakes with Astra node keep failing, refreshing metadata.",
+		gocql.NewLogFieldString("host_id", hostId),
+		gocql.NewLogFieldInt("failures", failures),
+		gocql.NewLogFieldError("error", err))
+	metadata, refreshErr := d.refreshMetadata(ctx)
+	if refreshErr != nil || metadata.degraded || metadata.ContactInfo.SniProxyAddress != sniAddr {
+		// Nothing shows the node is gone: the metadata is unknown, or the SNI proxy changed.
+		return err
+	}
+
+	probeId := ""
+	for _, contactPoint := range metadata.ContactInfo.ContactPoints {
+		if contactPoint != hostId {
+			probeId = contactPoint
+			break
+		}
+	}
+	if probeId == "" {
+		return err
+	}
+	probe, _, probeErr := d.dialIngress(ctx, sniAddr, probeId)
+	if probeErr != nil {
+		d.logger.Warning("Unable to reach Astra contact point through the SNI proxy, the failures aren't specific to the node.",
+			gocql.NewLogFieldString("host_id", hostId),
+			gocql.NewLogFieldString("contact_point", probeId),
+			gocql.NewLogFieldError("error", probeErr))
+		return err
+	}
+	_ = probe.Close()
+	d.hostFailures.confirmUnknown(hostId)
+	return &UnknownHostError{HostID: hostId, Failures: failures, Err: err}
+}
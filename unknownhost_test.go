@@ -0,0 +1,180 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostFailureTrackerRecord(t *testing.T) {
+	tracker := newHostFailureTracker(2)
+
+	failures, check, unknown := tracker.record("a", true)
+	require.Equal(t, 1, failures)
+	require.False(t, check)
+	require.False(t, unknown)
+	failures, check, _ = tracker.record("a", true)
+	require.Equal(t, 2, failures)
+	require.True(t, check)
+	// Checked recently, and the check didn't confirm anything
+	failures, check, unknown = tracker.record("a", true)
+	require.Equal(t, 3, failures)
+	require.False(t, check)
+	require.False(t, unknown)
+
+	// Another node is checked on its own schedule
+	_, _, _ = tracker.record("b", true)
+	_, check, _ = tracker.record("b", true)
+	require.True(t, check)
+	tracker.confirmUnknown("b")
+	_, check, unknown = tracker.record("b", true)
+	require.False(t, check)
+	require.True(t, unknown)
+
+	// Checked again once the interval elapsed, which resets the verdict
+	tracker.hosts["b"].lastCheck = time.Now().Add(-metadataRefreshRetryInterval)
+	_, check, unknown = tracker.record("b", true)
+	require.True(t, check)
+	require.False(t, unknown)
+
+	failures, check, unknown = tracker.record("a", false)
+	require.Equal(t, 0, failures)
+	require.False(t, check)
+	require.False(t, unknown)
+	require.NotContains(t, tracker.hosts, "a")
+
+	_, check, _ = newHostFailureTracker(0).record("a", true)
+	require.False(t, check)
+}
+
+func TestHostFailureTrackerPrune(t *testing.T) {
+	tracker := newHostFailureTracker(1)
+	_, _, _ = tracker.record("gone", true)
+	tracker.confirmUnknown("gone")
+	tracker.hosts["gone"].lastFailure = time.Now().Add(-hostFailureRetention)
+	tracker.lastPrune = time.Now().Add(-hostFailureRetention)
+
+	_, _, _ = tracker.record("other", true)
+	require.NotContains(t, tracker.hosts, "gone")
+	require.Contains(t, tracker.hosts, "other")
+}
+
+func TestCheckUnknownHostRefreshFailed(t *testing.T) {
+	d := newTestDialer(t, unreachableBundle(t), WithUnknownHostThreshold(1))
+
+	handshakeErr := &handshakeError{hostId: "host", addr: "ingress:29042", err: errors.New("tls: unrecognized name")}
+	err := d.checkUnknownHost(context.Background(), "ingress:29042", "host", handshakeErr)
+	require.Same(t, handshakeErr, err)
+
+	// Errors connecting to the SNI proxy say nothing about the node
+	connectErr := errors.New("connection refused")
+	require.Same(t, connectErr, d.checkUnknownHost(context.Background(), "ingress:29042", "host", connectErr))
+}
+
+// startSNIProxy starts a TLS server that rejects the handshakes for the host IDs in unknown, like the Astra SNI
+// proxy does for nodes it doesn't know.
+func startSNIProxy(t *testing.T, ca *testCA, unknown ...string) string {
+	t.Helper()
+	cert := ca.certificate(t, x509.ExtKeyUsageServerAuth, "127.0.0.1")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, hostId := range unknown {
+				if hello.ServerName == hostId {
+					return nil, fmt.Errorf("unknown host %v", hostId)
+				}
+			}
+			return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialNode dials hostId through the SNI proxy like DialHost does for a node.
+func dialNode(d *dialer, sniAddr, hostId string) error {
+	conn, _, err := d.dialIngress(context.Background(), sniAddr, hostId)
+	if err == nil {
+		_ = conn.Close()
+	}
+	return d.checkUnknownHost(context.Background(), sniAddr, hostId, err)
+}
+
+func TestCheckUnknownHost(t *testing.T) {
+	ca := newTestCA(t)
+	sniAddr := startSNIProxy(t, ca, "gone")
+	metadataService := startTestServer(t, ca, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"version":1,"region":"us-east1","contact_info":{"sni_proxy_address":%q,"contact_points":["a","b"]}}`, sniAddr)
+	}))
+	d := newTestDialer(t, serverBundle(t, ca, metadataService), WithUnknownHostThreshold(2))
+
+	err := dialNode(d, sniAddr, "gone")
+	var hsErr *handshakeError
+	require.ErrorAs(t, err, &hsErr)
+	var unknownErr *UnknownHostError
+	require.False(t, errors.As(err, &unknownErr))
+
+	// The threshold is reached and a contact point can be dialed through the SNI proxy. The verdict is remembered
+	// until the node is checked again.
+	for i := 0; i < 3; i++ {
+		err = dialNode(d, sniAddr, "gone")
+		require.ErrorAs(t, err, &unknownErr)
+		require.Equal(t, "gone", unknownErr.HostID)
+		require.Equal(t, i+2, unknownErr.Failures)
+	}
+
+	require.NoError(t, dialNode(d, sniAddr, "a"))
+}
+
+func TestCheckUnknownHostNotConfirmed(t *testing.T) {
+	ca := newTestCA(t)
+	// Every handshake fails, so the failures aren't specific to the node
+	sniAddr := startSNIProxy(t, ca, "gone", "a", "b")
+	metadataService := startTestServer(t, ca, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"version":1,"region":"us-east1","contact_info":{"sni_proxy_address":%q,"contact_points":["a","b"]}}`, sniAddr)
+	}))
+	d := newTestDialer(t, serverBundle(t, ca, metadataService), WithUnknownHostThreshold(1))
+
+	for i := 0; i < 2; i++ {
+		err := dialNode(d, sniAddr, "gone")
+		var hsErr *handshakeError
+		require.ErrorAs(t, err, &hsErr)
+		var unknownErr *UnknownHostError
+		require.False(t, errors.As(err, &unknownErr))
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// VerifyCertificateFunc performs additional verification of the certificates presented by Astra. It's called after
+// the chain was verified against the bundle's CA with the verified chains and the ID of the node being dialed, which
+// is empty for the Astra metadata service. Returning an error fails the TLS handshake.
+type VerifyCertificateFunc func(hostID string, verifiedChains [][]*x509.Certificate) error
+
+// SPKIHash returns the SPKI pin of cert, the base64 encoded SHA-256 hash of its DER encoded SubjectPublicKeyInfo, as
+// expected by WithSPKIPins.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parseSPKIPins decodes pins, each one optionally prefixed by "sha256/".
+func parseSPKIPins(pins []string) (map[[sha256.Size]byte]struct{}, error) {
+	if len(pins) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[[sha256.Size]byte]struct{}, len(pins))
+	for _, pin := range pins {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q, expected a base64 encoded SHA-256 hash", pin)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], sum)
+		parsed[key] = struct{}{}
+	}
+	return parsed, nil
+}
+
+// checkSPKIPins checks that a certificate of one of the verified chains matches one of the pins.
+func checkSPKIPins(verifiedChains [][]*x509.Certificate, pins map[[sha256.Size]byte]struct{}) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if _, ok := pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate presented by Astra matches the %d configured SPKI pins", len(pins))
+}
+
+func verifiedLeaf(verifiedChains [][]*x509.Certificate) *x509.Certificate {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return nil
+	}
+	return verifiedChains[0][0]
+}
+
+// verifyChains returns the verification of the dialer's pins and callback for a connection to hostId, or nil if
+// neither is configured.
+func (d *dialer) verifyChains(hostId string) func(verifiedChains [][]*x509.Certificate) error {
+	if len(d.spkiPins) == 0 && d.verifyCertificate == nil {
+		return nil
+	}
+	return func(verifiedChains [][]*x509.Certificate) error {
+		if len(d.spkiPins) > 0 {
+			if err := checkSPKIPins(verifiedChains, d.spkiPins); err != nil {
+				return &CertificateVerificationError{Step: VerificationStepSPKIPin, HostID: hostId, Certificate: verifiedLeaf(verifiedChains), Err: err}
+			}
+		}
+		if d.verifyCertificate != nil {
+			if err := d.verifyCertificate(hostId, verifiedChains); err != nil {
+				return &CertificateVerificationError{Step: VerificationStepCallback, HostID: hostId, Certificate: verifiedLeaf(verifiedChains), Err: err}
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocqlastra
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startVerifyServers starts an SNI proxy and a metadata service with certificates issued by a new CA, and returns
+// the CA, the address of the SNI proxy and the bundle.
+func startVerifyServers(t *testing.T) (*testCA, string, *LoadedBundle) {
+	t.Helper()
+	ca := newTestCA(t)
+	sniAddr := startSNIProxy(t, ca)
+	metadataService := startTestServer(t, ca, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"version":1,"region":"us-east1","contact_info":{"sni_proxy_address":"ingress:29042","contact_points":["a"]}}`))
+	}))
+	return ca, sniAddr, serverBundle(t, ca, metadataService)
+}
+
+func TestSPKIPinMatches(t *testing.T) {
+	ca, sniAddr, loaded := startVerifyServers(t)
+	otherPin := "sha256/" + SPKIHash(newTestCA(t).cert)
+	d := newTestDialer(t, loaded, WithSPKIPins(otherPin, SPKIHash(ca.cert)))
+
+	conn, _, err := d.dialIngress(context.Background(), sniAddr, "a")
+	require.NoError(t, err)
+	_ = conn.Close()
+	_, _, err = d.fetchMetadataOnce(context.Background(), loaded.Bundle)
+	require.NoError(t, err)
+}
+
+func TestSPKIPinMismatch(t *testing.T) {
+	_, sniAddr, loaded := startVerifyServers(t)
+	d := newTestDialer(t, loaded, WithSPKIPins(SPKIHash(newTestCA(t).cert)))
+
+	_, _, err := d.dialIngress(context.Background(), sniAddr, "a")
+	var verifyErr *CertificateVerificationError
+	require.ErrorAs(t, err, &verifyErr)
+	require.Equal(t, VerificationStepSPKIPin, verifyErr.Step)
+	require.Equal(t, "a", verifyErr.HostID)
+	require.NotNil(t, verifyErr.Certificate)
+
+	_, _, err = d.fetchMetadataOnce(context.Background(), loaded.Bundle)
+	require.ErrorAs(t, err, &verifyErr)
+	require.Equal(t, VerificationStepSPKIPin, verifyErr.Step)
+	require.Empty(t, verifyErr.HostID)
+}
+
+func TestSPKIPinInvalid(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	for _, pin := range []string{"not base64!", base64.StdEncoding.EncodeToString(sum[:16]), "sha1/" + base64.StdEncoding.EncodeToString(sum[:])} {
+		_, err := newDialer(unreachableBundle(t), 0, nil, []DialerOption{WithSPKIPins(pin)})
+		require.Error(t, err, pin)
+	}
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	ca, sniAddr, loaded := startVerifyServers(t)
+	var mu sync.Mutex
+	var hostIDs []string
+	d := newTestDialer(t, loaded, WithVerifyCertificate(func(hostID string, verifiedChains [][]*x509.Certificate) error {
+		mu.Lock()
+		defer mu.Unlock()
+		hostIDs = append(hostIDs, hostID)
+		if len(verifiedChains) != 1 || len(verifiedChains[0]) != 2 || !verifiedChains[0][1].Equal(ca.cert) {
+			return errors.New("unexpected verified chains")
+		}
+		if hostID == "rejected" {
+			return errors.New("rejected")
+		}
+		return nil
+	}))
+
+	conn, _, err := d.dialIngress(context.Background(), sniAddr, "a")
+	require.NoError(t, err)
+	_ = conn.Close()
+	_, _, err = d.fetchMetadataOnce(context.Background(), loaded.Bundle)
+	require.NoError(t, err)
+
+	_, _, err = d.dialIngress(context.Background(), sniAddr, "rejected")
+	var verifyErr *CertificateVerificationError
+	require.ErrorAs(t, err, &verifyErr)
+	require.Equal(t, VerificationStepCallback, verifyErr.Step)
+	require.Equal(t, "rejected", verifyErr.HostID)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"a", "", "rejected"}, hostIDs)
+}